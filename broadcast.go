@@ -0,0 +1,294 @@
+package otlog
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	shell "github.com/ipfs/go-ipfs-shell"
+
+	encrypt "github.com/tcfw/go-otlog/encrypt"
+)
+
+//ErrSubscriptionClosed the subscription was cancelled
+var ErrSubscriptionClosed = errors.New("Subscription closed")
+
+//HeadAnnouncement a signed announcement of a new log head
+type HeadAnnouncement struct {
+	Head      string    `json:"head"`
+	Time      time.Time `json:"t"`
+	PubCert   string    `json:"pk"`
+	Signature string    `json:"s"`
+}
+
+func (a *HeadAnnouncement) signed() []byte {
+	return []byte(a.Head + "\n" + a.Time.Format(time.RFC3339Nano))
+}
+
+//NewHeadAnnouncement signs an announcement of head
+func NewHeadAnnouncement(creds CredStore, head string) (*HeadAnnouncement, error) {
+	pubCert, err := creds.getPubcert()
+	if err != nil {
+		return nil, err
+	}
+
+	ann := &HeadAnnouncement{Head: head, Time: time.Now().UTC().Round(0), PubCert: pubCert}
+	sig, err := encrypt.Sign(ann.signed(), *creds.getPrivKey())
+	if err != nil {
+		return nil, err
+	}
+	ann.Signature = *sig
+	return ann, nil
+}
+
+//Verify checks the announcement was signed by the key of its attached cert
+func (a *HeadAnnouncement) Verify() error {
+	decoded, err := base64.StdEncoding.DecodeString(a.PubCert)
+	if err != nil {
+		return err
+	}
+	pubCert, err := x509.ParseCertificate(decoded)
+	if err != nil {
+		return err
+	}
+	pubKey, ok := pubCert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return errors.New("Announcement cert is not RSA")
+	}
+	return encrypt.Verify(a.Signature, a.signed(), *pubKey)
+}
+
+//HeadBroadcaster publishes head announcements to peers
+type HeadBroadcaster interface {
+	Publish(ann *HeadAnnouncement) error
+	Subscribe() (HeadSubscription, error)
+}
+
+//HeadSubscription receives head announcements, including those published by the subscriber
+type HeadSubscription interface {
+	//Next blocks until an announcement is received, ErrSubscriptionClosed is given once cancelled
+	Next() (*HeadAnnouncement, error)
+	Cancel() error
+}
+
+//MemBroadcaster broadcasts to subscribers in the same process
+type MemBroadcaster struct {
+	mu   sync.Mutex
+	subs map[*memSubscription]bool
+}
+
+//NewMemBroadcaster initiates a new in-process broadcaster
+func NewMemBroadcaster() *MemBroadcaster {
+	return &MemBroadcaster{subs: map[*memSubscription]bool{}}
+}
+
+//Publish queues the announcement for every subscriber, never blocking on slow subscribers
+func (b *MemBroadcaster) Publish(ann *HeadAnnouncement) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for sub := range b.subs {
+		cp := *ann
+		sub.push(&cp)
+	}
+	return nil
+}
+
+//Subscribe starts receiving announcements
+func (b *MemBroadcaster) Subscribe() (HeadSubscription, error) {
+	sub := &memSubscription{broadcaster: b}
+	sub.cond = sync.NewCond(&sub.mu)
+
+	b.mu.Lock()
+	b.subs[sub] = true
+	b.mu.Unlock()
+	return sub, nil
+}
+
+type memSubscription struct {
+	broadcaster *MemBroadcaster
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	queue  []*HeadAnnouncement
+	closed bool
+}
+
+func (s *memSubscription) push(ann *HeadAnnouncement) {
+	s.mu.Lock()
+	s.queue = append(s.queue, ann)
+	s.mu.Unlock()
+	s.cond.Signal()
+}
+
+func (s *memSubscription) Next() (*HeadAnnouncement, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for len(s.queue) == 0 && !s.closed {
+		s.cond.Wait()
+	}
+	if s.closed {
+		return nil, ErrSubscriptionClosed
+	}
+	ann := s.queue[0]
+	s.queue = s.queue[1:]
+	return ann, nil
+}
+
+func (s *memSubscription) Cancel() error {
+	s.broadcaster.mu.Lock()
+	delete(s.broadcaster.subs, s)
+	s.broadcaster.mu.Unlock()
+
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+	s.cond.Broadcast()
+	return nil
+}
+
+//IpfsBroadcaster broadcasts over an IPFS pubsub topic
+type IpfsBroadcaster struct {
+	Shell *shell.Shell
+	Topic string
+}
+
+//Publish sends the announcement to the topic
+func (b *IpfsBroadcaster) Publish(ann *HeadAnnouncement) error {
+	data, err := json.Marshal(ann)
+	if err != nil {
+		return err
+	}
+	return b.Shell.PubSubPublish(b.Topic, string(data))
+}
+
+//Subscribe starts receiving announcements from the topic
+func (b *IpfsBroadcaster) Subscribe() (HeadSubscription, error) {
+	sub, err := b.Shell.PubSubSubscribe(b.Topic)
+	if err != nil {
+		return nil, err
+	}
+	return &ipfsSubscription{sub: sub}, nil
+}
+
+type ipfsSubscription struct {
+	sub *shell.PubSubSubscription
+
+	mu     sync.Mutex
+	closed bool
+}
+
+//Next skips messages which are not announcements, as anyone may publish to the topic
+func (s *ipfsSubscription) Next() (*HeadAnnouncement, error) {
+	for {
+		msg, err := s.sub.Next()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return nil, ErrSubscriptionClosed
+			}
+			return nil, err
+		}
+
+		ann := &HeadAnnouncement{}
+		if err := json.Unmarshal(msg.Data(), ann); err == nil && ann.Head != "" {
+			return ann, nil
+		}
+	}
+}
+
+func (s *ipfsSubscription) Cancel() error {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+	return s.sub.Cancel()
+}
+
+//moveHead sets the head, announcing it when it changed and a broadcaster is set
+func (l *Log) moveHead(head string) error {
+	changed := l.head != head
+	l.setHead(head)
+	if !changed || l.Broadcaster == nil {
+		return nil
+	}
+
+	ann, err := NewHeadAnnouncement(l.credStore, head)
+	if err != nil {
+		return err
+	}
+	return l.Broadcaster.Publish(ann)
+}
+
+//Follow merges heads announced on the logs Broadcaster which the log does not already contain.
+//Their history is synced from remote first when given, IPFS stores fetch it themselves. Announcements
+//must be validly signed, and by a cert trusted by trust when set. handle is called with the resulting
+//head, or the error, of each announcement when given. Merges made here are not announced, otherwise
+//two peers merging each others merges would never settle. The returned func stops following
+func (l *Log) Follow(remote StorageEngine, trust *x509.CertPool, handle func(head string, err error)) (func() error, error) {
+	if l.Broadcaster == nil {
+		return nil, errors.New("Log has no broadcaster")
+	}
+	sub, err := l.Broadcaster.Subscribe()
+	if err != nil {
+		return nil, err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			ann, err := sub.Next()
+			if err == ErrSubscriptionClosed {
+				return
+			} else if err != nil {
+				if handle != nil {
+					handle("", err)
+				}
+				return
+			}
+
+			head, err := l.receive(ann, remote, trust)
+			if handle != nil {
+				handle(head, err)
+			}
+		}
+	}()
+
+	return func() error {
+		err := sub.Cancel()
+		<-done
+		return err
+	}, nil
+}
+
+func (l *Log) receive(ann *HeadAnnouncement, remote StorageEngine, trust *x509.CertPool) (string, error) {
+	if err := ann.Verify(); err != nil {
+		return "", err
+	}
+	if trust != nil {
+		if err := verifyTrust(ann.PubCert, trust); err != nil {
+			return "", err
+		}
+	}
+	if ann.Head == l.Head() {
+		return ann.Head, nil
+	}
+
+	if remote != nil {
+		if _, err := Sync(remote, l.store, []string{ann.Head}, nil); err != nil {
+			return "", err
+		}
+	}
+
+	if _, err := l.merge(ann.Head, false); err != nil {
+		return "", err
+	}
+	return l.Head(), nil
+}
@@ -0,0 +1,84 @@
+package otlog
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+type followEvent struct {
+	head string
+	err  error
+}
+
+func nextFollowEvent(t *testing.T, events chan followEvent) followEvent {
+	select {
+	case ev := <-events:
+		return ev
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for announcement")
+	}
+	return followEvent{}
+}
+
+func TestFollowMergesAnnouncedHeads(t *testing.T) {
+	a := newTestLog(t)
+	storeB := NewMemStore()
+	if _, err := Sync(a.store, storeB, []string{a.Head()}, nil); err != nil {
+		t.Fatal(err)
+	}
+	b := NewLog(a.credStore, storeB, a.Head())
+
+	broadcaster := NewMemBroadcaster()
+	a.Broadcaster = broadcaster
+	b.Broadcaster = broadcaster
+
+	events := make(chan followEvent, 16)
+	stop, err := b.Follow(a.store, nil, func(head string, err error) {
+		events <- followEvent{head, err}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+
+	//Fast-forward
+	if _, err := a.Append(upsertDiff(uuid.New(), `1`)); err != nil {
+		t.Fatal(err)
+	}
+	ev := nextFollowEvent(t, events)
+	assert.NoError(t, ev.err)
+	assert.Equal(t, a.Head(), ev.head)
+	assert.Equal(t, a.Head(), b.Head())
+
+	//Diverged heads are merged, the follower sees its own announcement first
+	if _, err := b.Append(upsertDiff(uuid.New(), `2`)); err != nil {
+		t.Fatal(err)
+	}
+	ev = nextFollowEvent(t, events)
+	assert.Equal(t, b.Head(), ev.head)
+
+	if _, err := a.Append(upsertDiff(uuid.New(), `3`)); err != nil {
+		t.Fatal(err)
+	}
+	ev = nextFollowEvent(t, events)
+	assert.NoError(t, ev.err)
+	merge, err := NewEntryFromStorage(storeB, b.credStore, b.Head())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, OpMerge, merge.Operation)
+	records, _ := b.Records()
+	assert.Len(t, records, 3)
+
+	//Forged announcements are dropped
+	head := b.Head()
+	forged, _ := NewHeadAnnouncement(a.credStore, a.Head())
+	forged.Head = "forged"
+	broadcaster.Publish(forged)
+	ev = nextFollowEvent(t, events)
+	assert.Error(t, ev.err)
+	assert.Equal(t, head, b.Head())
+}
@@ -0,0 +1,293 @@
+package otlog
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+//BlockStore is a storage engine holding objects as raw content-addressed blocks, such as IPFS.
+//Bundles carry its blocks unchanged so they can be loaded with `ipfs dag import`
+type BlockStore interface {
+	GetBlock(ref string) ([]byte, error)
+}
+
+//ExportBundle writes the entries reachable from head, with their snapshots and shards, as a CARv1
+//archive rooted at head. Objects of stores addressing by hex sha256, e.g. MemStore, are written as
+//raw JSON blocks. History pruned behind a checkpoint is left out
+func (l *Log) ExportBundle(head string, w io.Writer) error {
+	wants, err := negotiate(l.store, NewMemStore(), []string{head})
+	if err != nil {
+		return err
+	}
+
+	root, err := refCID(head)
+	if err != nil {
+		return err
+	}
+	cw, err := newCARWriter(w, []cid{root})
+	if err != nil {
+		return err
+	}
+
+	kinds := []struct {
+		refs []string
+		kind objectKind
+	}{
+		{wants.shards, objectShard},
+		{wants.snapshots, objectSnapshot},
+		{wants.entries, objectEntry},
+	}
+	for _, k := range kinds {
+		for _, ref := range k.refs {
+			c, data, err := exportBlock(l.store, ref, k.kind)
+			if err != nil {
+				return err
+			}
+			if err := cw.Block(c, data); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func exportBlock(store StorageEngine, ref string, kind objectKind) (cid, []byte, error) {
+	c, err := refCID(ref)
+	if err != nil {
+		return cid{}, nil, err
+	}
+
+	if blocks, ok := store.(BlockStore); ok {
+		data, err := blocks.GetBlock(ref)
+		return c, data, err
+	}
+
+	var obj interface{}
+	switch kind {
+	case objectEntry:
+		obj, err = store.Get(&Entry{dataStore: store, isEncrypted: true}, ref)
+	case objectSnapshot:
+		obj, err = store.GetSnapshot(ref)
+	case objectShard:
+		obj, err = store.GetShard(ref)
+	}
+	if err != nil {
+		return cid{}, nil, err
+	}
+
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return cid{}, nil, err
+	}
+	sum := sha256.Sum256(data)
+	if c.Codec != codecRaw || !bytes.Equal(sum[:], c.Digest) {
+		return cid{}, nil, fmt.Errorf("Store does not address %s by the sha256 of its JSON", ref)
+	}
+	return c, data, nil
+}
+
+//maxBundleSize the most block data ImportBundle holds in memory while a bundle is validated
+var maxBundleSize = 512 << 20
+
+//ImportBundle reads a CARv1 bundle and stores the history of its roots, giving the roots as stored.
+//Every block must match its hash and every entry and snapshot the store lacks must decrypt with creds
+//and carry a valid signature, otherwise nothing is stored. Entries are re-addressed for stores which
+//address them differently to the bundle, trie snapshots are signed over their links so can not be
+func ImportBundle(r io.Reader, store StorageEngine, creds CredStore) ([]string, error) {
+	cr, err := newCARReader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	staged := &bundleStore{blocks: map[string][]byte{}}
+	size := 0
+	for {
+		c, data, err := cr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		if size += len(data); size > maxBundleSize {
+			return nil, fmt.Errorf("Bundle is larger than %d bytes", maxBundleSize)
+		}
+
+		switch c.Codec {
+		case codecRaw, codecDagJSON:
+		case codecDagCBOR:
+			if data, err = cborToJSON(data); err != nil {
+				return nil, fmt.Errorf("Block %s: %s", c, err)
+			}
+		default:
+			return nil, fmt.Errorf("Unsupported codec 0x%x for block %s", c.Codec, c)
+		}
+		staged.blocks[c.ref()] = data
+	}
+
+	roots := make([]string, len(cr.Roots))
+	for i, root := range cr.Roots {
+		roots[i] = root.ref()
+	}
+
+	wants, err := negotiate(staged, store, roots)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ref := range wants.entries {
+		if _, err := NewEntryFromStorage(staged, creds, ref); err != nil {
+			return nil, fmt.Errorf("Entry %s is not valid: %s", ref, err)
+		}
+	}
+	for _, ref := range wants.snapshots {
+		snapshot, err := RecoverSnapshot(ref, staged)
+		if err != nil {
+			return nil, err
+		}
+		if err := snapshot.GetRecords(creds, &json.RawMessage{}); err != nil {
+			return nil, fmt.Errorf("Snapshot %s is not valid: %s", ref, err)
+		}
+	}
+
+	stored, err := staged.store(wants, store)
+	if err != nil {
+		return nil, err
+	}
+	for i, root := range roots {
+		if ref, ok := stored[root]; ok {
+			roots[i] = ref
+		}
+	}
+	return roots, nil
+}
+
+//bundleStore holds the blocks of a bundle as JSON while they are validated
+type bundleStore struct {
+	blocks map[string][]byte
+}
+
+func (b *bundleStore) unmarshal(ref string, v interface{}) error {
+	data, ok := b.blocks[ref]
+	if !ok {
+		return fmt.Errorf("Bundle is missing %s", ref)
+	}
+	return json.Unmarshal(data, v)
+}
+
+//Get decodes an entry from the bundle
+func (b *bundleStore) Get(entry *Entry, ref string) (*Entry, error) {
+	if err := b.unmarshal(ref, entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+//Save bundles are read only
+func (b *bundleStore) Save(data interface{}) (string, error) {
+	return "", errors.New("Bundles are read only")
+}
+
+//GetSnapshot decodes a snapshot from the bundle
+func (b *bundleStore) GetSnapshot(ref string) (*Snapshot, error) {
+	snapshot := &Snapshot{}
+	return snapshot, b.unmarshal(ref, snapshot)
+}
+
+//GetShard decodes a snapshot shard from the bundle
+func (b *bundleStore) GetShard(ref string) (*SnapshotShard, error) {
+	shard := &SnapshotShard{}
+	return shard, b.unmarshal(ref, shard)
+}
+
+//store saves the wanted objects to the store, dependencies first, giving the ref each was stored as.
+//Entry links are rewritten to the refs of re-addressed entries and snapshots
+func (b *bundleStore) store(wants *syncWants, store StorageEngine) (map[string]string, error) {
+	stored := map[string]string{}
+
+	for _, ref := range wants.shards {
+		shard, err := b.GetShard(ref)
+		if err != nil {
+			return nil, err
+		}
+		if err := syncSave(store, ref, shard); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, ref := range wants.snapshots {
+		snapshot, err := b.GetSnapshot(ref)
+		if err != nil {
+			return nil, err
+		}
+		if snapshot.Root != nil {
+			if err := syncSave(store, ref, snapshot); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if stored[ref], err = store.Save(snapshot); err != nil {
+			return nil, err
+		}
+	}
+
+	graph := storeGraph(store)
+	for _, ref := range wants.entries {
+		entry, err := b.Get(&Entry{dataStore: b, isEncrypted: true}, ref)
+		if err != nil {
+			return nil, err
+		}
+		for _, parent := range entry.Parent {
+			if parent != nil && stored[parent.Target] != "" {
+				parent.Target = stored[parent.Target]
+			}
+		}
+		if entry.Snapshot != nil && stored[entry.Snapshot.Target] != "" {
+			entry.Snapshot.Target = stored[entry.Snapshot.Target]
+		}
+
+		saved, err := store.Save(entry)
+		if err != nil {
+			return nil, err
+		}
+		if graph != nil {
+			if _, err := graph.Add(saved, entry); err != nil {
+				return nil, err
+			}
+		}
+		stored[ref] = saved
+	}
+	return stored, nil
+}
+
+//cborToJSON converts a DAG-CBOR block to DAG-JSON, which the objects of a log decode from
+func cborToJSON(data []byte) ([]byte, error) {
+	v, err := cborDecode(data)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(dagJSON(v))
+}
+
+func dagJSON(v interface{}) interface{} {
+	switch val := v.(type) {
+	case cid:
+		return map[string]string{"/": val.String()}
+	case []byte:
+		return map[string]interface{}{"/": map[string]string{"bytes": base64.RawStdEncoding.EncodeToString(val)}}
+	case []interface{}:
+		for i := range val {
+			val[i] = dagJSON(val[i])
+		}
+	case map[string]interface{}:
+		for k := range val {
+			val[k] = dagJSON(val[k])
+		}
+	}
+	return v
+}
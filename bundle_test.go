@@ -0,0 +1,174 @@
+package otlog
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"io/ioutil"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBundle(t *testing.T) {
+	log := newTestLog(t)
+	log.Snapshots = SnapshotPolicy{EveryEntries: 2}
+	for i := 0; i < 5; i++ {
+		log.Append(upsertDiff(uuid.New(), `1`))
+	}
+
+	buf := &bytes.Buffer{}
+	if err := log.ExportBundle(log.Head(), buf); err != nil {
+		t.Fatal(err)
+	}
+
+	store := NewMemStore()
+	roots, err := ImportBundle(bytes.NewReader(buf.Bytes()), store, log.credStore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{log.Head()}, roots)
+
+	replica := NewLog(log.credStore, store, roots[0])
+	records, err := replica.Records()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, records, 5)
+	verify, _ := replica.Verify(roots[0], nil)
+	assert.True(t, verify.OK(), "%v", verify.Problems)
+
+	//Tampered blocks fail their hash
+	tampered := append([]byte{}, buf.Bytes()...)
+	tampered[len(tampered)-2] ^= 1
+	store = NewMemStore()
+	_, err = ImportBundle(bytes.NewReader(tampered), store, log.credStore)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "does not match its hash")
+	}
+	assert.Empty(t, store.Entries)
+
+	//Entries must decrypt and validate with the creds
+	privKey, pubCert, _ := generateTestKeys()
+	wrong, _ := NewCredStore("wrong", *privKey, *pubCert)
+	_, err = ImportBundle(bytes.NewReader(buf.Bytes()), store, *wrong)
+	assert.Error(t, err)
+	assert.Empty(t, store.Entries)
+}
+
+func TestBundleCID(t *testing.T) {
+	v0 := "QmYwAPJzv5CZsnA625s3Xf2nemtYgPpHdWEz79ojWnPbdG"
+	c, err := parseCID(v0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 0, c.Version)
+	assert.Equal(t, v0, c.String())
+
+	v1 := cid{Version: 1, Codec: codecDagCBOR, Digest: c.Digest}
+	assert.True(t, strings.HasPrefix(v1.String(), "bafyrei"))
+	parsed, err := parseCID(v1.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, v1, parsed)
+
+	buf := &bytes.Buffer{}
+	if _, err := newCARWriter(buf, []cid{v1}); err != nil {
+		t.Fatal(err)
+	}
+	cr, err := newCARReader(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []cid{v1}, cr.Roots)
+}
+
+//loadFixtureCreds the creds the testdata fixtures were written with
+func loadFixtureCreds(t *testing.T) CredStore {
+	raw, err := ioutil.ReadFile("testdata/key.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyBlock, rest := pem.Decode(raw)
+	certBlock, _ := pem.Decode(rest)
+	privKey, err := x509.ParsePKCS1PrivateKey(keyBlock.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubCert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	creds, err := NewCredStore(TestPass, *privKey, *pubCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *creds
+}
+
+func TestBundleDagCBOR(t *testing.T) {
+	creds := loadFixtureCreds(t)
+
+	//A base entry and an upsert linking to it, stored as DAG-CBOR blocks as IPFS stores them
+	bundle, err := ioutil.ReadFile("testdata/entries.car")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := NewMemStore()
+	roots, err := ImportBundle(bytes.NewReader(bundle), store, creds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, store.Entries, 2)
+
+	//Re-addressed for the MemStore
+	assert.Len(t, roots, 1)
+	assert.NotEqual(t, "bafyreifh55kbdtwm7j44ir255kvu4st233jla5nzufnntnujclgruokttm", roots[0])
+
+	replica := NewLog(creds, store, roots[0])
+	records, err := replica.Records()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, records, 1)
+	assert.Equal(t, `"fixture"`, string(records[0].Raw))
+	verify, err := replica.Verify(roots[0], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, verify.OK(), "%v", verify.Problems)
+	assert.Equal(t, 2, verify.Entries)
+
+	//Bundles too large to hold are refused
+	limit := maxBundleSize
+	maxBundleSize = 1024
+	defer func() { maxBundleSize = limit }()
+	_, err = ImportBundle(bytes.NewReader(bundle), NewMemStore(), creds)
+	assert.Error(t, err)
+}
+
+func TestCBORDecodeNestedLengths(t *testing.T) {
+	//Nested lists each claiming every byte left, then padding of zero items
+	data := []byte{}
+	for i := 0; i < cborMaxDepth-1; i++ {
+		data = append(data, 0x9a, 0, 0, 0, 0)
+	}
+	data = append(data, make([]byte, 64<<10)...)
+	for i := 0; i < cborMaxDepth-1; i++ {
+		binary.BigEndian.PutUint32(data[i*5+1:], uint32(len(data)-(i+1)*5))
+	}
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err := cborDecode(data)
+	runtime.ReadMemStats(&after)
+
+	assert.Equal(t, errCBORShort, err)
+	assert.True(t, after.TotalAlloc-before.TotalAlloc < 16<<20, "allocated %d bytes", after.TotalAlloc-before.TotalAlloc)
+}
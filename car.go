@@ -0,0 +1,526 @@
+package otlog
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"sort"
+)
+
+//Multicodec codes used in CIDs
+const (
+	codecDagPB   = 0x70
+	codecRaw     = 0x55
+	codecDagCBOR = 0x71
+	codecDagJSON = 0x0129
+	mhSHA256     = 0x12
+)
+
+//maxCARSection the largest CAR header or block accepted
+const maxCARSection = 64 << 20
+
+var cidBase32 = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+//cid a content identifier, only sha2-256 multihashes are supported
+type cid struct {
+	Version int
+	Codec   uint64
+	Digest  []byte
+}
+
+func uvarint(v uint64) []byte {
+	buf := make([]byte, binary.MaxVarintLen64)
+	return buf[:binary.PutUvarint(buf, v)]
+}
+
+func (c cid) Bytes() []byte {
+	mh := append(uvarint(mhSHA256), uvarint(uint64(len(c.Digest)))...)
+	mh = append(mh, c.Digest...)
+	if c.Version == 0 {
+		return mh
+	}
+
+	b := append(uvarint(1), uvarint(c.Codec)...)
+	return append(b, mh...)
+}
+
+func (c cid) String() string {
+	if c.Version == 0 {
+		return base58Encode(c.Bytes())
+	}
+	return "b" + cidBase32.EncodeToString(c.Bytes())
+}
+
+//parseCID decodes a CIDv0 or a base32 or base58btc CIDv1 string
+func parseCID(s string) (cid, error) {
+	var raw []byte
+	var err error
+	switch {
+	case len(s) == 46 && s[:2] == "Qm":
+		raw, err = base58Decode(s)
+	case len(s) > 1 && s[0] == 'b':
+		raw, err = cidBase32.DecodeString(s[1:])
+	case len(s) > 1 && s[0] == 'z':
+		raw, err = base58Decode(s[1:])
+	default:
+		return cid{}, fmt.Errorf("Unsupported CID %s", s)
+	}
+	if err != nil {
+		return cid{}, err
+	}
+
+	c, n, err := readCID(raw)
+	if err != nil {
+		return cid{}, err
+	}
+	if n != len(raw) {
+		return cid{}, fmt.Errorf("Trailing bytes in CID %s", s)
+	}
+	return c, nil
+}
+
+//readCID reads a binary CID from the start of b, giving the number of bytes read
+func readCID(b []byte) (cid, int, error) {
+	pos := 0
+	next := func() (uint64, error) {
+		v, n := binary.Uvarint(b[pos:])
+		if n <= 0 {
+			return 0, errors.New("Invalid varint in CID")
+		}
+		pos += n
+		return v, nil
+	}
+
+	c := cid{Version: 1}
+	version, err := next()
+	if err != nil {
+		return cid{}, 0, err
+	}
+	if version == mhSHA256 {
+		//CIDv0 is a bare sha2-256 multihash
+		c.Version, c.Codec = 0, codecDagPB
+	} else if version != 1 {
+		return cid{}, 0, fmt.Errorf("Unsupported CID version %d", version)
+	} else {
+		if c.Codec, err = next(); err != nil {
+			return cid{}, 0, err
+		}
+		code, err := next()
+		if err != nil {
+			return cid{}, 0, err
+		}
+		if code != mhSHA256 {
+			return cid{}, 0, fmt.Errorf("Unsupported multihash 0x%x", code)
+		}
+	}
+
+	size, err := next()
+	if err != nil {
+		return cid{}, 0, err
+	}
+	if size != sha256.Size || len(b)-pos < sha256.Size {
+		return cid{}, 0, fmt.Errorf("Invalid sha2-256 digest length %d", size)
+	}
+	c.Digest = append([]byte{}, b[pos:pos+sha256.Size]...)
+	return c, pos + sha256.Size, nil
+}
+
+//refCID the CID of a store ref, IPFS refs are CIDs and other stores use hex sha256 digests of raw blocks
+func refCID(ref string) (cid, error) {
+	if digest, err := hex.DecodeString(ref); err == nil && len(digest) == sha256.Size {
+		return cid{Version: 1, Codec: codecRaw, Digest: digest}, nil
+	}
+	return parseCID(ref)
+}
+
+//ref the store ref for the CID, the inverse of refCID
+func (c cid) ref() string {
+	if c.Version == 1 && c.Codec == codecRaw {
+		return hex.EncodeToString(c.Digest)
+	}
+	return c.String()
+}
+
+func base58Encode(b []byte) string {
+	n := new(big.Int).SetBytes(b)
+	radix, mod := big.NewInt(58), new(big.Int)
+	out := []byte{}
+	for n.Sign() > 0 {
+		n.DivMod(n, radix, mod)
+		out = append(out, base58Alphabet[mod.Int64()])
+	}
+	for _, c := range b {
+		if c != 0 {
+			break
+		}
+		out = append(out, base58Alphabet[0])
+	}
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return string(out)
+}
+
+func base58Decode(s string) ([]byte, error) {
+	n, radix := new(big.Int), big.NewInt(58)
+	zeros := 0
+	for i, c := range []byte(s) {
+		d := bytes.IndexByte([]byte(base58Alphabet), c)
+		if d < 0 {
+			return nil, fmt.Errorf("Invalid base58 character %q", c)
+		}
+		if d == 0 && i == zeros {
+			zeros++
+		}
+		n.Mul(n, radix)
+		n.Add(n, big.NewInt(int64(d)))
+	}
+	return append(make([]byte, zeros), n.Bytes()...), nil
+}
+
+//carWriter writes a CARv1 archive
+type carWriter struct {
+	w io.Writer
+}
+
+func newCARWriter(w io.Writer, roots []cid) (*carWriter, error) {
+	links := make([]interface{}, len(roots))
+	for i, root := range roots {
+		links[i] = root
+	}
+
+	header, err := cborEncode(map[string]interface{}{"roots": links, "version": uint64(1)})
+	if err != nil {
+		return nil, err
+	}
+	cw := &carWriter{w: w}
+	return cw, cw.section(header)
+}
+
+func (cw *carWriter) section(parts ...[]byte) error {
+	size := 0
+	for _, part := range parts {
+		size += len(part)
+	}
+	if _, err := cw.w.Write(uvarint(uint64(size))); err != nil {
+		return err
+	}
+	for _, part := range parts {
+		if _, err := cw.w.Write(part); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//Block writes a block, its CID is not checked against the data
+func (cw *carWriter) Block(c cid, data []byte) error {
+	return cw.section(c.Bytes(), data)
+}
+
+//carReader reads a CARv1 archive
+type carReader struct {
+	r     *bufio.Reader
+	Roots []cid
+}
+
+func newCARReader(r io.Reader) (*carReader, error) {
+	cr := &carReader{r: bufio.NewReader(r)}
+	header, err := cr.section()
+	if err == io.EOF {
+		return nil, errors.New("Bundle is empty")
+	} else if err != nil {
+		return nil, err
+	}
+
+	decoded, err := cborDecode(header)
+	if err != nil {
+		return nil, err
+	}
+	fields, ok := decoded.(map[string]interface{})
+	if !ok || fields["version"] != uint64(1) {
+		return nil, errors.New("Bundle is not a CARv1 archive")
+	}
+	roots, _ := fields["roots"].([]interface{})
+	for _, root := range roots {
+		link, ok := root.(cid)
+		if !ok {
+			return nil, errors.New("Bundle root is not a CID")
+		}
+		cr.Roots = append(cr.Roots, link)
+	}
+	return cr, nil
+}
+
+func (cr *carReader) section() ([]byte, error) {
+	size, err := binary.ReadUvarint(cr.r)
+	if err != nil {
+		return nil, err
+	}
+	if size > maxCARSection {
+		return nil, fmt.Errorf("Bundle section of %d bytes is too large", size)
+	}
+
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(cr.r, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+//Next reads the next block, checking it hashes to its CID. io.EOF is given after the last block
+func (cr *carReader) Next() (cid, []byte, error) {
+	sec, err := cr.section()
+	if err != nil {
+		return cid{}, nil, err
+	}
+
+	c, n, err := readCID(sec)
+	if err != nil {
+		return cid{}, nil, err
+	}
+	data := sec[n:]
+
+	sum := sha256.Sum256(data)
+	if !bytes.Equal(sum[:], c.Digest) {
+		return cid{}, nil, fmt.Errorf("Block %s does not match its hash", c)
+	}
+	return c, data, nil
+}
+
+//cborEncode encodes maps, lists, strings, unsigned ints and CID links as DAG-CBOR
+func cborEncode(v interface{}) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	err := cborWrite(buf, v)
+	return buf.Bytes(), err
+}
+
+func cborHead(buf *bytes.Buffer, major byte, n uint64) {
+	switch {
+	case n < 24:
+		buf.WriteByte(major<<5 | byte(n))
+	case n <= math.MaxUint8:
+		buf.WriteByte(major<<5 | 24)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(major<<5 | 25)
+		b := make([]byte, 2)
+		binary.BigEndian.PutUint16(b, uint16(n))
+		buf.Write(b)
+	case n <= math.MaxUint32:
+		buf.WriteByte(major<<5 | 26)
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, uint32(n))
+		buf.Write(b)
+	default:
+		buf.WriteByte(major<<5 | 27)
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, n)
+		buf.Write(b)
+	}
+}
+
+func cborWrite(buf *bytes.Buffer, v interface{}) error {
+	switch val := v.(type) {
+	case uint64:
+		cborHead(buf, 0, val)
+	case string:
+		cborHead(buf, 3, uint64(len(val)))
+		buf.WriteString(val)
+	case cid:
+		//Links are tag 42 over the binary CID with a leading identity multibase byte
+		cborHead(buf, 6, 42)
+		b := append([]byte{0}, val.Bytes()...)
+		cborHead(buf, 2, uint64(len(b)))
+		buf.Write(b)
+	case []interface{}:
+		cborHead(buf, 4, uint64(len(val)))
+		for _, item := range val {
+			if err := cborWrite(buf, item); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		//DAG-CBOR orders keys by length then bytewise
+		keys := make([]string, 0, len(val))
+		for k := range val {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			if len(keys[i]) != len(keys[j]) {
+				return len(keys[i]) < len(keys[j])
+			}
+			return keys[i] < keys[j]
+		})
+		cborHead(buf, 5, uint64(len(val)))
+		for _, k := range keys {
+			cborWrite(buf, k)
+			if err := cborWrite(buf, val[k]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("Unsupported CBOR type %T", v)
+	}
+	return nil
+}
+
+//cborDecode decodes a DAG-CBOR item, links are decoded as cid
+func cborDecode(data []byte) (interface{}, error) {
+	d := &cborDecoder{data: data}
+	v, err := d.item(0)
+	if err != nil {
+		return nil, err
+	}
+	if d.pos != len(d.data) {
+		return nil, errors.New("Trailing bytes after CBOR item")
+	}
+	return v, nil
+}
+
+//cborMaxDepth limits nesting so hostile input cannot exhaust the stack
+const cborMaxDepth = 64
+
+var errCBORShort = errors.New("CBOR item is truncated")
+
+type cborDecoder struct {
+	data []byte
+	pos  int
+}
+
+func (d *cborDecoder) next(n uint64) ([]byte, error) {
+	if n > uint64(len(d.data)-d.pos) {
+		return nil, errCBORShort
+	}
+	b := d.data[d.pos : d.pos+int(n)]
+	d.pos += int(n)
+	return b, nil
+}
+
+func (d *cborDecoder) head() (byte, byte, uint64, error) {
+	b, err := d.next(1)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	major, info := b[0]>>5, b[0]&0x1f
+
+	var arg []byte
+	switch {
+	case info < 24:
+		return major, info, uint64(info), nil
+	case info <= 27:
+		if arg, err = d.next(1 << (info - 24)); err != nil {
+			return 0, 0, 0, err
+		}
+	default:
+		return 0, 0, 0, errors.New("Indefinite length CBOR items are not DAG-CBOR")
+	}
+
+	n := uint64(0)
+	for _, c := range arg {
+		n = n<<8 | uint64(c)
+	}
+	return major, info, n, nil
+}
+
+func (d *cborDecoder) item(depth int) (interface{}, error) {
+	if depth > cborMaxDepth {
+		return nil, errors.New("CBOR nested too deeply")
+	}
+
+	major, info, n, err := d.head()
+	if err != nil {
+		return nil, err
+	}
+
+	switch major {
+	case 0:
+		return n, nil
+	case 1:
+		return -1 - int64(n), nil
+	case 2:
+		b, err := d.next(n)
+		return append([]byte{}, b...), err
+	case 3:
+		b, err := d.next(n)
+		return string(b), err
+	case 4:
+		//Each item takes at least a byte, nested lengths may each claim all of what is left so
+		//lists and maps grow as their items are read rather than being preallocated
+		if n > uint64(len(d.data)-d.pos) {
+			return nil, errCBORShort
+		}
+		list := []interface{}{}
+		for i := uint64(0); i < n; i++ {
+			v, err := d.item(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		return list, nil
+	case 5:
+		if n > uint64(len(d.data)-d.pos)/2 {
+			return nil, errCBORShort
+		}
+		m := map[string]interface{}{}
+		for i := uint64(0); i < n; i++ {
+			k, err := d.item(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, errors.New("DAG-CBOR map keys must be strings")
+			}
+			if m[key], err = d.item(depth + 1); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	case 6:
+		if n != 42 {
+			return nil, fmt.Errorf("Unsupported CBOR tag %d", n)
+		}
+		v, err := d.item(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		b, ok := v.([]byte)
+		if !ok || len(b) == 0 || b[0] != 0 {
+			return nil, errors.New("Invalid CID link")
+		}
+		c, read, err := readCID(b[1:])
+		if err != nil {
+			return nil, err
+		}
+		if read != len(b)-1 {
+			return nil, errors.New("Trailing bytes in CID link")
+		}
+		return c, nil
+	default:
+		switch {
+		case info == 20:
+			return false, nil
+		case info == 21:
+			return true, nil
+		case info == 22:
+			return nil, nil
+		case info == 26:
+			return float64(math.Float32frombits(uint32(n))), nil
+		case info == 27:
+			return math.Float64frombits(n), nil
+		}
+		return nil, fmt.Errorf("Unsupported CBOR simple value %d", info)
+	}
+}
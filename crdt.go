@@ -0,0 +1,232 @@
+package otlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/google/uuid"
+)
+
+//CRDTType the conflict free replicated data type of a record field
+type CRDTType string
+
+const (
+	//CRDTCounter a positive-negative counter
+	CRDTCounter CRDTType = "pnc"
+
+	//CRDTSet an observed-remove set
+	CRDTSet CRDTType = "ors"
+
+	//CRDTRegister a last-writer-wins register
+	CRDTRegister CRDTType = "lww"
+
+	//CRDTMultiValue a multi-value register which keeps concurrent writes
+	CRDTMultiValue CRDTType = "mvr"
+)
+
+//FieldOp an operation against a single CRDT field of a record, to be carried in EntryDiff.Fields
+type FieldOp struct {
+	Type   CRDTType        `json:"t"`
+	Field  string          `json:"f"`
+	Delta  int64           `json:"n,omitempty"`
+	Value  json.RawMessage `json:"v,omitempty"`
+	Tag    string          `json:"tag,omitempty"`
+	Remove []string        `json:"rm,omitempty"`
+}
+
+//Field holds the replicated state of a CRDT field
+type Field struct {
+	Type    CRDTType                   `json:"t"`
+	Counter int64                      `json:"n,omitempty"`
+	Entries map[string]json.RawMessage `json:"e,omitempty"`
+	Value   json.RawMessage            `json:"v,omitempty"`
+	Clock   *HLC                       `json:"h,omitempty"`
+	Tag     string                     `json:"tag,omitempty"`
+}
+
+//NewCounterOp increments a counter field, negative deltas decrement
+func NewCounterOp(field string, delta int64) FieldOp {
+	return FieldOp{Type: CRDTCounter, Field: field, Delta: delta}
+}
+
+//NewSetAddOp adds a value to a set field
+func NewSetAddOp(field string, value interface{}) (FieldOp, error) {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return FieldOp{}, err
+	}
+
+	return FieldOp{Type: CRDTSet, Field: field, Value: raw, Tag: uuid.New().String()}, nil
+}
+
+//NewSetRemoveOp removes every instance of value observed in the current record from a set field
+func NewSetRemoveOp(field string, value interface{}, current *Record) (FieldOp, error) {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return FieldOp{}, err
+	}
+
+	op := FieldOp{Type: CRDTSet, Field: field}
+	if f := current.field(field); f != nil {
+		for tag, val := range f.Entries {
+			if bytes.Equal(val, raw) {
+				op.Remove = append(op.Remove, tag)
+			}
+		}
+	}
+	sort.Strings(op.Remove)
+
+	return op, nil
+}
+
+//NewRegisterOp sets a last-writer-wins register field, writes are ordered by the HLC of their entries
+func NewRegisterOp(field string, value interface{}) (FieldOp, error) {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return FieldOp{}, err
+	}
+
+	return FieldOp{Type: CRDTRegister, Field: field, Value: raw, Tag: uuid.New().String()}, nil
+}
+
+//NewMultiValueOp sets a multi-value register field, replacing the values observed in the current record
+func NewMultiValueOp(field string, value interface{}, current *Record) (FieldOp, error) {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return FieldOp{}, err
+	}
+
+	op := FieldOp{Type: CRDTMultiValue, Field: field, Value: raw, Tag: uuid.New().String()}
+	if f := current.field(field); f != nil {
+		for tag := range f.Entries {
+			op.Remove = append(op.Remove, tag)
+		}
+	}
+	sort.Strings(op.Remove)
+
+	return op, nil
+}
+
+//apply merges a field operation made at the given time into the field state, all operations commute.
+//The first type a field is given in playback order wins, operations of any other type are dropped
+func (f *Field) apply(op FieldOp, at HLC) error {
+	if f.Type != op.Type {
+		return nil
+	}
+
+	switch op.Type {
+	case CRDTCounter:
+		f.Counter += op.Delta
+	case CRDTSet, CRDTMultiValue:
+		for _, tag := range op.Remove {
+			delete(f.Entries, tag)
+		}
+		if op.Tag != "" && op.Value != nil {
+			if f.Entries == nil {
+				f.Entries = map[string]json.RawMessage{}
+			}
+			f.Entries[op.Tag] = op.Value
+		}
+	case CRDTRegister:
+		if f.Clock == nil || at.Compare(*f.Clock) > 0 || (at.Compare(*f.Clock) == 0 && op.Tag > f.Tag) {
+			f.Value = op.Value
+			f.Clock = &at
+			f.Tag = op.Tag
+		}
+	default:
+		return fmt.Errorf("Unknown CRDT type %s", op.Type)
+	}
+
+	return nil
+}
+
+func (f *Field) clone() *Field {
+	c := *f
+	if f.Entries != nil {
+		c.Entries = make(map[string]json.RawMessage, len(f.Entries))
+		for tag, val := range f.Entries {
+			c.Entries[tag] = val
+		}
+	}
+	return &c
+}
+
+//applyFieldOps applies CRDT operations made at the given time to a copy of the record
+func applyFieldOps(rec Record, ops []FieldOp, at HLC) (Record, error) {
+	fields := make(map[string]*Field, len(rec.Fields)+len(ops))
+	for name, f := range rec.Fields {
+		fields[name] = f.clone()
+	}
+
+	for _, op := range ops {
+		f, ok := fields[op.Field]
+		if !ok {
+			f = &Field{Type: op.Type}
+			fields[op.Field] = f
+		}
+		if err := f.apply(op, at); err != nil {
+			return rec, err
+		}
+	}
+
+	rec.Fields = fields
+	return rec, nil
+}
+
+func (r *Record) field(name string) *Field {
+	if r == nil || r.Fields == nil {
+		return nil
+	}
+	return r.Fields[name]
+}
+
+//Counter the current value of a counter field
+func (r *Record) Counter(name string) int64 {
+	if f := r.field(name); f != nil {
+		return f.Counter
+	}
+	return 0
+}
+
+//SetMembers the distinct values of a set field, sorted by their JSON encoding
+func (r *Record) SetMembers(name string) []json.RawMessage {
+	f := r.field(name)
+	if f == nil {
+		return nil
+	}
+
+	members := []json.RawMessage{}
+	for _, val := range f.sortedValues() {
+		if len(members) == 0 || !bytes.Equal(members[len(members)-1], val) {
+			members = append(members, val)
+		}
+	}
+	return members
+}
+
+//Register the current value of a last-writer-wins register field
+func (r *Record) Register(name string) json.RawMessage {
+	if f := r.field(name); f != nil {
+		return f.Value
+	}
+	return nil
+}
+
+//MultiValues the concurrently written values of a multi-value register field
+func (r *Record) MultiValues(name string) []json.RawMessage {
+	if f := r.field(name); f != nil {
+		return f.sortedValues()
+	}
+	return nil
+}
+
+func (f *Field) sortedValues() []json.RawMessage {
+	vals := make([]json.RawMessage, 0, len(f.Entries))
+	for _, val := range f.Entries {
+		vals = append(vals, val)
+	}
+	sort.Slice(vals, func(i, j int) bool { return bytes.Compare(vals[i], vals[j]) < 0 })
+	return vals
+}
@@ -0,0 +1,220 @@
+package otlog
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCRDTFieldOps(t *testing.T) {
+	rec := Record{ID: uuid.New()}
+
+	add1, _ := NewSetAddOp("tags", "a")
+	add2, _ := NewSetAddOp("tags", "b")
+	add3, _ := NewSetAddOp("tags", "a")
+	rec, err := applyFieldOps(rec, []FieldOp{NewCounterOp("n", 5), NewCounterOp("n", -2), add1, add2, add3}, HLC{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, int64(3), rec.Counter("n"))
+	assert.Equal(t, []json.RawMessage{json.RawMessage(`"a"`), json.RawMessage(`"b"`)}, rec.SetMembers("tags"))
+
+	remove, _ := NewSetRemoveOp("tags", "a", &rec)
+	assert.Len(t, remove.Remove, 2)
+	rec, _ = applyFieldOps(rec, []FieldOp{remove}, HLC{})
+	assert.Equal(t, []json.RawMessage{json.RawMessage(`"b"`)}, rec.SetMembers("tags"))
+
+	//Mismatched types are dropped, the field keeps its first type
+	reg, _ := NewRegisterOp("n", "x")
+	rec, err = applyFieldOps(rec, []FieldOp{reg, NewCounterOp("n", 1)}, HLC{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, CRDTCounter, rec.Fields["n"].Type)
+	assert.Equal(t, int64(4), rec.Counter("n"))
+	assert.Nil(t, rec.Register("n"))
+}
+
+func TestCRDTConcurrentOpsCommute(t *testing.T) {
+	base := Record{ID: uuid.New()}
+	base, _ = applyFieldOps(base, []FieldOp{mustOp(NewMultiValueOp("title", "base", &base))}, HLC{Wall: 1})
+
+	//Two replicas writing concurrently against the same base
+	opsA := []FieldOp{
+		NewCounterOp("n", 2),
+		mustOp(NewRegisterOp("owner", "alice")),
+		mustOp(NewMultiValueOp("title", "A", &base)),
+		mustOp(NewSetAddOp("tags", "x")),
+	}
+	opsB := []FieldOp{
+		NewCounterOp("n", 3),
+		mustOp(NewRegisterOp("owner", "bob")),
+		mustOp(NewMultiValueOp("title", "B", &base)),
+		mustOp(NewSetRemoveOp("tags", "x", &base)),
+	}
+
+	atA := HLC{Wall: 2, Node: "a"}
+	atB := HLC{Wall: 2, Node: "b"}
+
+	ab, _ := applyFieldOps(base, opsA, atA)
+	ab, err := applyFieldOps(ab, opsB, atB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ba, _ := applyFieldOps(base, opsB, atB)
+	ba, err = applyFieldOps(ba, opsA, atA)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.EqualValues(t, ab, ba)
+	assert.Equal(t, int64(5), ab.Counter("n"))
+	assert.Equal(t, json.RawMessage(`"bob"`), ab.Register("owner"))
+	assert.Equal(t, []json.RawMessage{json.RawMessage(`"A"`), json.RawMessage(`"B"`)}, ab.MultiValues("title"))
+	assert.Equal(t, []json.RawMessage{json.RawMessage(`"x"`)}, ab.SetMembers("tags"))
+}
+
+func TestCRDTCounterMerge(t *testing.T) {
+	/*
+		Test:
+			   (B)root
+			    /\
+			   /  \
+		(C)entry 1  (C)entry 2
+			   .    .
+			    .  .
+			   merge
+
+		entry 1 increments by 2, entry 2 by 3, merge must hold 5
+	*/
+
+	memStore := NewMemStore()
+	credStore := generateTestCredStore()
+	recID := uuid.New()
+
+	root, _ := NewEntry(nil, *credStore, memStore)
+	root.Operation = OpBase
+	rootRef, _ := root.Save("")
+
+	entry1, _ := NewEntry(&Link{rootRef}, *credStore, memStore)
+	entry1.Operation = OpCRDT
+	entry1Diff := &EntryDiff{Op: OpCRDT, Record: Record{ID: recID}, Fields: []FieldOp{NewCounterOp("n", 2)}}
+	entry1Rec, _ := applyFieldOps(Record{ID: recID}, entry1Diff.Fields, HLC{})
+	entry1.Snapshot, _ = (&Records{Records: []Record{entry1Rec}, store: memStore}).Snapshot(*credStore)
+	entry1.EncryptFromJSON(entry1Diff)
+	entry1.Save("")
+
+	entry2, _ := NewEntry(&Link{rootRef}, *credStore, memStore)
+	entry2.Operation = OpCRDT
+	entry2.EncryptFromJSON(&EntryDiff{Op: OpCRDT, Record: Record{ID: recID}, Fields: []FieldOp{NewCounterOp("n", 3)}})
+	entry2.Save("")
+
+	merge, mRecs, err := entry1.Merge(entry2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, OpMerge, merge.Operation)
+	assert.Len(t, mRecs, 1)
+	assert.Equal(t, int64(5), mRecs[0].Counter("n"))
+}
+
+func mustOp(op FieldOp, err error) FieldOp {
+	if err != nil {
+		panic(err)
+	}
+	return op
+}
+
+func TestCRDTOpsAfterDelete(t *testing.T) {
+	/*
+		Test:
+			     root
+			      |
+			   (U)base
+			    /    \
+			(D)del  (C)concurrent
+			   |       .
+			(C)after   .
+			   .     .
+			    merge
+
+		the counter increment written after the delete recreates the record, the
+		concurrent increment is dropped whichever order they are played in
+	*/
+
+	memStore := NewMemStore()
+	credStore := *generateTestCredStore()
+	recID := uuid.New()
+	increment := func(n int64) EntryDiff {
+		return EntryDiff{Op: OpCRDT, Record: Record{ID: recID}, Fields: []FieldOp{NewCounterOp("n", n)}}
+	}
+
+	root, _ := NewEntry(nil, credStore, memStore)
+	root.Operation = OpBase
+	rootRef, _ := root.Save("")
+	_, baseRef := appendTestEntry(t, rootRef, EntryDiff{Op: OpUpSert, Record: Record{ID: recID, Raw: []byte(`1`)}}, credStore, memStore)
+
+	for _, concurrentFirst := range []bool{true, false} {
+		var concurrent *Entry
+		if concurrentFirst {
+			concurrent, _ = appendTestEntry(t, baseRef, increment(5), credStore, memStore)
+		}
+		_, delRef := appendTestEntry(t, baseRef, EntryDiff{Op: OpDel, Record: Record{ID: recID, Deleted: true}}, credStore, memStore)
+		after, _ := appendTestEntry(t, delRef, increment(2), credStore, memStore)
+		if !concurrentFirst {
+			concurrent, _ = appendTestEntry(t, baseRef, increment(5), credStore, memStore)
+		}
+
+		_, mRecs, err := after.Merge(concurrent)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if assert.Len(t, mRecs, 1) {
+			assert.False(t, mRecs[0].Deleted)
+			assert.Equal(t, int64(2), mRecs[0].Counter("n"))
+		}
+	}
+
+	//Without anything written after it the delete wins
+	_, delRef := appendTestEntry(t, baseRef, EntryDiff{Op: OpDel, Record: Record{ID: recID, Deleted: true}}, credStore, memStore)
+	del, _ := NewEntryFromStorage(memStore, credStore, delRef)
+	concurrent, _ := appendTestEntry(t, baseRef, increment(5), credStore, memStore)
+	_, mRecs, err := del.Merge(concurrent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.Len(t, mRecs, 1) {
+		assert.True(t, mRecs[0].Deleted)
+		assert.Zero(t, mRecs[0].Counter("n"))
+	}
+}
+
+func TestCRDTTypeClashMerges(t *testing.T) {
+	memStore := NewMemStore()
+	credStore := *generateTestCredStore()
+	recID := uuid.New()
+
+	root, _ := NewEntry(nil, credStore, memStore)
+	root.Operation = OpBase
+	rootRef, _ := root.Save("")
+
+	counter, _ := appendTestEntry(t, rootRef, EntryDiff{Op: OpCRDT, Record: Record{ID: recID}, Fields: []FieldOp{NewCounterOp("n", 2)}}, credStore, memStore)
+	reg := mustOp(NewRegisterOp("n", "x"))
+	register, _ := appendTestEntry(t, rootRef, EntryDiff{Op: OpCRDT, Record: Record{ID: recID}, Fields: []FieldOp{reg}}, credStore, memStore)
+
+	//The counter is played first so its type wins, from either side of the merge
+	for _, heads := range [][2]*Entry{{counter, register}, {register, counter}} {
+		_, mRecs, err := heads[0].Merge(heads[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if assert.Len(t, mRecs, 1) {
+			assert.Equal(t, CRDTCounter, mRecs[0].Fields["n"].Type)
+			assert.Equal(t, int64(2), mRecs[0].Counter("n"))
+		}
+	}
+}
@@ -2,8 +2,10 @@ package otlog
 
 import (
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
 )
 
@@ -12,6 +14,7 @@ type CredStore struct {
 	pass    string
 	privKey rsa.PrivateKey
 	pubCert x509.Certificate
+	clock   *HybridClock
 }
 
 //NewCredStore constructors of basic cred store
@@ -24,9 +27,16 @@ func NewCredStore(pass string, privKey rsa.PrivateKey, pubCert x509.Certificate)
 		pass:    pass,
 		privKey: privKey,
 		pubCert: pubCert,
+		clock:   NewHybridClock(certNodeID(pubCert)),
 	}, nil
 }
 
+//certNodeID identifies the writing node by the fingerprint of its certificate
+func certNodeID(cert x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:8])
+}
+
 func (e *CredStore) getPass() string {
 	return e.pass
 }
@@ -38,3 +48,10 @@ func (e *CredStore) getPrivKey() *rsa.PrivateKey {
 func (e *CredStore) getPubcert() (string, error) {
 	return base64.StdEncoding.EncodeToString(e.pubCert.Raw), nil
 }
+
+func (e *CredStore) getClock() *HybridClock {
+	if e.clock == nil {
+		return NewHybridClock(certNodeID(e.pubCert))
+	}
+	return e.clock
+}
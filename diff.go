@@ -4,4 +4,5 @@ package otlog
 type EntryDiff struct {
 	Op     Operation `json:"op"`
 	Record Record    `json:"d"`
+	Fields []FieldOp `json:"f,omitempty"`
 }
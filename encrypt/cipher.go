@@ -3,6 +3,7 @@ package encrypt
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/rand"
 	"crypto/sha512"
 	"encoding/hex"
 	"errors"
@@ -65,3 +66,47 @@ func Dec(data *[]byte, ts time.Time, pk string) (*[]byte, error) {
 
 	return &output, nil
 }
+
+//Seal encrypts data using AES-256-GCM with a random nonce, prefixed to the output, for data
+//which shares a timestamp with other data under the same key
+func Seal(data []byte, pk string) ([]byte, error) {
+	aesgcm, err := newGCM(pk)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aesgcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return aesgcm.Seal(nonce, nonce, data, nil), nil
+}
+
+//Open decrypts data sealed by Seal
+func Open(data []byte, pk string) ([]byte, error) {
+	aesgcm, err := newGCM(pk)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < aesgcm.NonceSize() {
+		return nil, errors.New("cipher text too short")
+	}
+
+	return aesgcm.Open(nil, data[:aesgcm.NonceSize()], data[aesgcm.NonceSize():], nil)
+}
+
+func newGCM(pk string) (cipher.AEAD, error) {
+	k, _ := hex.DecodeString(pk)
+	if len(k) < 32 {
+		return nil, errors.New("key length too short")
+	}
+
+	block, err := aes.NewCipher(k[:32])
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,16 @@
+package encrypt
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+//Digest a keyed HMAC-SHA256 of data, allows comparing plain text without revealing it
+func Digest(data []byte, pk string) string {
+	k, _ := hex.DecodeString(pk)
+
+	mac := hmac.New(sha256.New, k)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -1,11 +1,14 @@
 package otlog
 
 import (
+	"container/heap"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"sort"
 	"time"
 
 	"github.com/google/uuid"
@@ -26,10 +29,21 @@ const (
 	//OpMerge allows for merge operations between other logs
 	OpMerge Operation = "merg"
 
+	//OpCRDT applies conflict free field operations to a record
+	OpCRDT Operation = "crdt"
+
 	//OpBase used only for root nodes
 	OpBase Operation = "base"
+
+	//OpCheckpoint attaches a snapshot of the full record set, history before it may be pruned
+	OpCheckpoint Operation = "ckpt"
 )
 
+//hasDiff whether entries of the operation carry an EntryDiff
+func (o Operation) hasDiff() bool {
+	return o != OpMerge && o != OpBase && o != OpCheckpoint
+}
+
 //Link provies DAG links/Merkle leaf nodes for IPFS
 type Link struct {
 	Target string `json:"/"`
@@ -40,8 +54,10 @@ type Entry struct {
 	credStore   CredStore
 	dataStore   StorageEngine
 	isEncrypted bool
+	ref         string
 
 	Time       time.Time `json:"t"`
+	Clock      *HLC      `json:"h,omitempty"`
 	ID         uuid.UUID `json:"id"`
 	CrytpoAlg  string    `json:"c"`
 	PublicCert string    `json:"pk"`
@@ -50,6 +66,7 @@ type Entry struct {
 	Data       string    `json:"d"`
 	Operation  Operation `json:"o"`
 	Parent     []*Link   `json:"p,omitempty"`
+	Generation uint64    `json:"g,omitempty,string"`
 }
 
 //NewEntry creates a new entry with populated properties
@@ -76,30 +93,25 @@ func NewEntryFromStorage(storage StorageEngine, credStore CredStore, head string
 	if err != nil {
 		return nil, err
 	}
+	entry.ref = head
 
 	err = entry.DecryptData()
 	if err != nil {
 		return nil, err
 	}
 
+	if graph := storeGraph(storage); graph != nil {
+		if _, err := graph.Add(head, entry); err != nil {
+			return nil, err
+		}
+	}
+
 	return entry, nil
 }
 
 //Parents provides a map the entries parent(s) ~ multiple for merges
 func (e *Entry) Parents() (map[string]*Entry, error) {
-	parents := map[string]*Entry{}
-	if e.Parent != nil && len(e.Parent) > 0 {
-		for _, parent := range e.Parent {
-			if parent != nil {
-				entry, err := NewEntryFromStorage(e.dataStore, e.credStore, parent.Target)
-				if err != nil {
-					return nil, err
-				}
-				parents[parent.Target] = entry
-			}
-		}
-	}
-	return parents, nil
+	return fetchEntries(e.dataStore, e.credStore, e.parentRefs())
 }
 
 //Encrypt alias for EncryptString
@@ -217,6 +229,7 @@ func (e *Entry) encryptBytes(data []byte) error {
 	}
 	e.Data = base64.StdEncoding.EncodeToString(*raw)
 	e.isEncrypted = true
+	e.ref = ""
 
 	return nil
 }
@@ -227,46 +240,129 @@ func (e *Entry) Save(previous string) (string, error) {
 		e.Parent = []*Link{{Target: previous}}
 	}
 
+	if err := e.stamp(); err != nil {
+		return "", err
+	}
+
 	if !e.isEncrypted {
 		e.Encrypt(e.Data)
 	}
 
-	return e.dataStore.Save(e)
+	ref, err := e.dataStore.Save(e)
+	if err != nil {
+		return "", err
+	}
+	e.ref = ref
+
+	if graph := storeGraph(e.dataStore); graph != nil {
+		if _, err := graph.Add(ref, e); err != nil {
+			return "", err
+		}
+	}
+
+	return ref, nil
+}
+
+//storedRef the ref the entry was fetched or saved under, entries not yet stored are saved
+func (e *Entry) storedRef() (string, error) {
+	if e.ref != "" {
+		return e.ref, nil
+	}
+	return e.Save("")
+}
+
+//stamp sets the entry clock to follow all of its parents and its generation to one more
+//than the highest parent generation, once set neither is changed and stored entries are never
+//stamped as that would change their ref
+func (e *Entry) stamp() error {
+	if e.Clock != nil || e.ref != "" {
+		return nil
+	}
+
+	walker := newGraphWalker(e.dataStore)
+	parents := []string{}
+	for _, parent := range e.Parent {
+		if parent != nil {
+			parents = append(parents, parent.Target)
+		}
+	}
+	if err := walker.prefetch(parents); err != nil {
+		return err
+	}
+
+	remotes := make([]HLC, 0, len(parents))
+	generation := uint64(0)
+	for _, pRef := range parents {
+		node, err := walker.node(pRef)
+		if err != nil {
+			return err
+		}
+		remotes = append(remotes, node.clock())
+		if node.Generation > generation {
+			generation = node.Generation
+		}
+	}
+
+	clock := e.credStore.getClock().Update(remotes...)
+	e.Clock = &clock
+	e.Generation = generation + 1
+
+	return nil
+}
+
+//clock the entries HLC, falling back to wall clock time for entries written without one
+func (e *Entry) clock() HLC {
+	if e.Clock == nil {
+		return HLC{Wall: e.Time.UnixNano()}
+	}
+	return *e.Clock
 }
 
 //Merge merges 2 entry chains into a single chain
 func (e *Entry) Merge(sibling *Entry) (*Entry, []Record, error) {
+	return MergeMany(e, sibling)
+}
+
+//MergeMany merges any number of entry chains into a single octopus merge entry with a parent per head
+func MergeMany(heads ...*Entry) (*Entry, []Record, error) {
 	/*
 		# Find common base
-		# Collate entries between logs into list sorted by time (diff)
-		# Walk through changes (priorities delete over upsert)
+		# Collate entries of all logs since the base (diff)
+		# Replay changes onto the base records in playback order
 		# Create snapshot of records
-		# Create new entry as merge refing snapshot and both parents
+		# Create new entry as merge refing snapshot and all parents
+
+		Merging heads in any order replays the same entries in the same
+		order from the same base, so all produce identical records
 	*/
 
-	eRef, err := e.Save("")
-	if err != nil {
-		return nil, nil, err
-	}
-	sRef, err := sibling.Save("")
-	if err != nil {
-		return nil, nil, err
+	if len(heads) < 2 {
+		return nil, nil, errors.New("at least 2 heads are required to merge")
 	}
+	e := heads[0]
 
-	_, mapping, err := e.findCommonAncestor(sibling)
-	if err != nil {
-		return nil, nil, err
+	parents := []*Link{}
+	seen := map[string]bool{}
+	for _, head := range heads {
+		ref, err := head.storedRef()
+		if err != nil {
+			return nil, nil, err
+		}
+		if !seen[ref] {
+			seen[ref] = true
+			parents = append(parents, &Link{ref})
+		}
 	}
-
-	if e.Snapshot == nil {
-		return nil, nil, errors.New("no snapshot attached")
+	if len(parents) < 2 {
+		return nil, nil, errors.New("at least 2 distinct heads are required to merge")
 	}
-	originalSnapshot, err := RecoverSnapshot(e.Snapshot.Target, e.dataStore)
+
+	base, err := findMergeBase(heads)
 	if err != nil {
 		return nil, nil, err
 	}
-	records := &Records{}
-	err = originalSnapshot.GetRecords(e.credStore, records)
+
+	records, err := e.recordsAt(base)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -276,7 +372,7 @@ func (e *Entry) Merge(sibling *Entry) (*Entry, []Record, error) {
 		return nil, nil, err
 	}
 
-	mergedRecords, err := e.difference(mapping, sibling, records)
+	mergedRecords, err := e.difference(base, heads, records)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -290,80 +386,295 @@ func (e *Entry) Merge(sibling *Entry) (*Entry, []Record, error) {
 
 	mergeEntry.Operation = OpMerge
 	mergeEntry.Snapshot = snapshotRef
-	mergeEntry.Parent = []*Link{{eRef}, {sRef}}
+	mergeEntry.Parent = parents
 
 	return mergeEntry, mergedRecords, nil
 }
 
-func (e *Entry) difference(mapping *lcaMapping, sibling *Entry, records *Records) ([]Record, error) {
+//findMergeBase finds a common ancestor of all heads by folding the pairwise LCA over each head
+func findMergeBase(heads []*Entry) (string, error) {
+	walker := newGraphWalker(heads[0].dataStore)
 
-	sRef, err := sibling.Save("")
+	baseRef, err := heads[0].storedRef()
 	if err != nil {
-		return nil, err
+		return "", err
 	}
+	for _, head := range heads[1:] {
+		ref, err := head.storedRef()
+		if err != nil {
+			return "", err
+		}
+		lca, _, err := walker.lowestCommonAncestor(baseRef, ref)
+		if err != nil {
+			return "", err
+		}
+		if lca == nil {
+			return "", errors.New("no common ancestor")
+		}
+		baseRef = *lca
+	}
+	return baseRef, nil
+}
 
-	mergedRecords := []Record{}
+//recordsAt recovers the record set as of the given entry, replaying entries since the nearest
+//snapshot on its ancestry or since the root when no snapshot exists
+func (e *Entry) recordsAt(ref string) (*Records, error) {
+	records := &Records{Records: []Record{}}
 
-	if mapping == nil {
-		//Assume simple 1 depth merge
-		//Use ours ~ playforward diff
-		//Create new snap
+	snapshotRef, snapshotTarget, err := newGraphWalker(e.dataStore).nearestSnapshot(ref)
+	if err != nil {
+		return nil, err
+	}
 
-		sibDiff, err := sibling.DataToStruct(&EntryDiff{})
+	if snapshotTarget != "" {
+		snapshot, err := RecoverSnapshot(snapshotTarget, e.dataStore)
 		if err != nil {
 			return nil, err
 		}
-		sibDiffT := sibDiff.(*EntryDiff)
-
-		records.Records, err = e.applyDiff(*sibDiffT, records.Records)
+		err = snapshot.GetRecords(e.credStore, records)
 		if err != nil {
 			return nil, err
 		}
-		mergedRecords = records.Records
-	} else {
-		//Multi diff path
+		records.previous = snapshot
+		if snapshotRef == ref {
+			return records, nil
+		}
+	}
 
-		uncommon := map[string]*Entry{sRef: sibling}
+	head, err := NewEntryFromStorage(e.dataStore, e.credStore, ref)
+	if err != nil {
+		return nil, err
+	}
 
-		for ref := range mapping.ChildrenB {
-			if _, ok := mapping.ChildrenA[ref]; !ok {
-				entry, err := NewEntryFromStorage(e.dataStore, e.credStore, ref)
-				if err != nil {
-					return nil, err
+	records.Records, err = e.difference(snapshotRef, []*Entry{head}, records)
+	if err != nil {
+		return nil, err
+	}
+
+	return records, nil
+}
+
+//nearestSnapshot searches the ancestry of ref breadth first for the closest entry with a snapshot attached
+//giving the entry and snapshot refs, entries at the same distance are preferred by ref
+func (w *graphWalker) nearestSnapshot(ref string) (string, string, error) {
+	visited := map[string]bool{ref: true}
+	level := []string{ref}
+
+	for len(level) > 0 {
+		sort.Strings(level)
+
+		next := []string{}
+		if err := w.prefetch(level); err != nil {
+			return "", "", err
+		}
+		for _, lRef := range level {
+			node, err := w.node(lRef)
+			if err != nil {
+				return "", "", err
+			}
+			if node.Snapshot != "" {
+				return lRef, node.Snapshot, nil
+			}
+			for _, pRef := range node.Parents {
+				if !visited[pRef] {
+					visited[pRef] = true
+					next = append(next, pRef)
 				}
-				uncommon[ref] = entry
 			}
 		}
+		level = next
+	}
+
+	return "", "", nil
+}
+
+//difference replays every entry of the chains which is not part of the base onto the base records,
+//an empty base replays the chains from their roots
+func (e *Entry) difference(base string, heads []*Entry, records *Records) ([]Record, error) {
+	headRefs := make([]string, 0, len(heads))
+	for _, head := range heads {
+		ref, err := head.storedRef()
+		if err != nil {
+			return nil, err
+		}
+		headRefs = append(headRefs, ref)
+	}
+
+	since, err := newGraphWalker(e.dataStore).since(headRefs, base)
+	if err != nil {
+		return nil, err
+	}
+
+	uncommon, err := fetchEntries(e.dataStore, e.credStore, since)
+	if err != nil {
+		return nil, err
+	}
 
-		playBackUnCommon := []*Entry{}
-		for _, entry := range uncommon {
-			if len(playBackUnCommon) == 0 || playBackUnCommon[len(playBackUnCommon)-1].Time.Before(entry.Time) {
-				playBackUnCommon = append(playBackUnCommon, entry)
-			} else {
-				playBackUnCommon = append([]*Entry{entry}, playBackUnCommon...)
+	mergedRecords := records.Records
+	for _, entry := range playbackOrder(uncommon) {
+		if !entry.Operation.hasDiff() {
+			continue
+		}
+		diff, err := entry.DataToStruct(&EntryDiff{})
+		if err != nil {
+			return nil, err
+		}
+		diffTyped := diff.(*EntryDiff)
+		mergedRecords, err = e.applyDiff(*diffTyped, entry.clock(), entry.parentRefs(), mergedRecords)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return mergedRecords, nil
+}
+
+//since the refs reachable from the heads which are not reachable from base, an empty base gives the
+//full history. Nodes are visited once from the highest generation down, so a node's flags are final
+//when it is popped and the walk stops as soon as only base history is left queued
+func (w *graphWalker) since(heads []string, base string) ([]string, error) {
+	const (
+		fromHead = 1 << iota
+		fromBase
+	)
+
+	flags := map[string]int{}
+	queue := &generationQueue{}
+	pending := 0
+
+	push := func(ref string, flag int) error {
+		prev, seen := flags[ref]
+		flags[ref] = prev | flag
+		if seen {
+			if prev&fromBase == 0 && flag&fromBase != 0 {
+				pending--
+			}
+			return nil
+		}
+
+		node, err := w.node(ref)
+		if err != nil {
+			return err
+		}
+		if flag&fromBase == 0 {
+			pending++
+		}
+		heap.Push(queue, generationItem{ref, node.Generation})
+		return nil
+	}
+
+	if base != "" {
+		if err := push(base, fromBase); err != nil {
+			return nil, err
+		}
+	}
+	for _, ref := range heads {
+		if err := push(ref, fromHead); err != nil {
+			return nil, err
+		}
+	}
+
+	refs := []string{}
+	for pending > 0 {
+		ref := heap.Pop(queue).(generationItem).ref
+		flag := flags[ref]
+		if flag&fromBase == 0 {
+			pending--
+			refs = append(refs, ref)
+		}
+
+		node, err := w.node(ref)
+		if err != nil {
+			return nil, err
+		}
+		if err := w.prefetch(node.Parents); err != nil {
+			return nil, err
+		}
+		for _, pRef := range node.Parents {
+			if err := push(pRef, flag); err != nil {
+				return nil, err
 			}
 		}
+	}
+
+	return refs, nil
+}
 
-		for _, entry := range playBackUnCommon {
-			if entry.Operation == OpMerge {
+//playbackOrder orders entries so parents always come before their children,
+//otherwise by their HLC with ties broken by entry ref
+func playbackOrder(entries map[string]*Entry) []*Entry {
+	pending := map[string]int{}
+	children := map[string][]string{}
+	for ref, entry := range entries {
+		for _, parent := range entry.Parent {
+			if parent == nil {
 				continue
 			}
-			diff, err := entry.DataToStruct(&EntryDiff{})
-			if err != nil {
-				return nil, err
+			if _, ok := entries[parent.Target]; ok {
+				pending[ref]++
+				children[parent.Target] = append(children[parent.Target], ref)
 			}
-			diffTyped := diff.(*EntryDiff)
-			records.Records, err = e.applyDiff(*diffTyped, records.Records)
-			if err != nil {
-				return nil, err
+		}
+	}
+
+	ready := &playbackQueue{entries: entries}
+	for ref := range entries {
+		if pending[ref] == 0 {
+			heap.Push(ready, ref)
+		}
+	}
+
+	ordered := make([]*Entry, 0, len(entries))
+	for ready.Len() > 0 {
+		ref := heap.Pop(ready).(string)
+		ordered = append(ordered, entries[ref])
+		for _, child := range children[ref] {
+			pending[child]--
+			if pending[child] == 0 {
+				heap.Push(ready, child)
 			}
-			mergedRecords = records.Records
 		}
 	}
-	return mergedRecords, nil
+	return ordered
+}
+
+//playbackQueue a heap of entry refs ordered by HLC then ref
+type playbackQueue struct {
+	entries map[string]*Entry
+	refs    []string
+}
+
+func (q *playbackQueue) Len() int { return len(q.refs) }
+
+func (q *playbackQueue) Less(i, j int) bool {
+	if c := q.entries[q.refs[i]].clock().Compare(q.entries[q.refs[j]].clock()); c != 0 {
+		return c < 0
+	}
+	return q.refs[i] < q.refs[j]
+}
+
+func (q *playbackQueue) Swap(i, j int) { q.refs[i], q.refs[j] = q.refs[j], q.refs[i] }
+
+func (q *playbackQueue) Push(x interface{}) { q.refs = append(q.refs, x.(string)) }
+
+func (q *playbackQueue) Pop() interface{} {
+	ref := q.refs[len(q.refs)-1]
+	q.refs = q.refs[:len(q.refs)-1]
+	return ref
 }
 
-func (e *Entry) applyDiff(diff EntryDiff, records []Record) ([]Record, error) {
+//parentRefs the refs of the entries parents
+func (e *Entry) parentRefs() []string {
+	refs := []string{}
+	for _, parent := range e.Parent {
+		if parent != nil {
+			refs = append(refs, parent.Target)
+		}
+	}
+	return refs
+}
+
+//applyDiff applies the diff of an entry written at the given time on top of parents to the records
+func (e *Entry) applyDiff(diff EntryDiff, at HLC, parents []string, records []Record) ([]Record, error) {
 	index := -1
 	for i, rec := range records {
 		if rec.ID == diff.Record.ID {
@@ -373,132 +684,174 @@ func (e *Entry) applyDiff(diff EntryDiff, records []Record) ([]Record, error) {
 	}
 	switch diff.Op {
 	case OpUpSert:
-		if index > 0 {
+		if index >= 0 {
+			if diff.Record.Fields == nil {
+				diff.Record.Fields = records[index].Fields
+			}
 			records[index] = diff.Record
-		} else {
-			return append(records, diff.Record), nil
+			return records, nil
 		}
+		return append(records, diff.Record), nil
 	case OpDel:
-		records[index] = Record{records[index].ID, nil, true}
-		return records[:len(records)-1], nil
+		//Keep a tombstone so the outcome does not depend on whether the record was seen
+		deletedAt := at
+		if index < 0 {
+			return append(records, Record{ID: diff.Record.ID, Deleted: true, DeletedAt: &deletedAt}), nil
+		}
+		//Concurrent deletes keep the latest clock, so the outcome does not depend on playback order
+		if prior := records[index].DeletedAt; prior != nil && at.Before(*prior) {
+			deletedAt = *prior
+		}
+		records[index] = Record{ID: records[index].ID, Deleted: true, DeletedAt: &deletedAt}
+		return records, nil
+	case OpCRDT:
+		if index < 0 {
+			rec, err := applyFieldOps(Record{ID: diff.Record.ID}, diff.Fields, at)
+			if err != nil {
+				return nil, err
+			}
+			return append(records, rec), nil
+		}
+		//Deletes win over concurrent field changes, changes written after the delete recreate the record
+		rec := records[index]
+		if rec.Deleted && rec.DeletedAt == nil {
+			return records, nil
+		}
+		if rec.DeletedAt != nil {
+			observed := at.Compare(*rec.DeletedAt) > 0
+			if observed {
+				var err error
+				if observed, err = newGraphWalker(e.dataStore).observes(parents, *rec.DeletedAt); err != nil {
+					return nil, err
+				}
+			}
+			if !observed {
+				return records, nil
+			}
+			if rec.Deleted {
+				rec = Record{ID: rec.ID, DeletedAt: rec.DeletedAt}
+			}
+		}
+		rec, err := applyFieldOps(rec, diff.Fields, at)
+		if err != nil {
+			return nil, err
+		}
+		records[index] = rec
+		return records, nil
 	}
-	return []Record{}, nil
+	return nil, fmt.Errorf("Unknown operation %s", diff.Op)
 }
 
+//lcaMapping the refs each side reached before meeting at the LCA
 type lcaMapping struct {
-	ChildrenA refTree
-	ChildrenB refTree
-	Depths    map[string]int
+	ReachedA map[string]bool
+	ReachedB map[string]bool
 }
 
-type refTree map[string]map[string]bool
+const (
+	reachedA = 1 << iota
+	reachedB
+)
 
+//findCommonAncestor finds the lowest common ancestor of the entry and its sibling
 func (e *Entry) findCommonAncestor(sibling *Entry) (*string, *lcaMapping, error) {
 	if len(e.Parent) == 0 {
 		return nil, nil, nil
 	}
 
-	// Test 1 depth
-	eParents, err := e.Parents()
+	eRef, err := e.storedRef()
 	if err != nil {
 		return nil, nil, err
 	}
-	sParents, err := sibling.Parents()
+	sRef, err := sibling.storedRef()
 	if err != nil {
 		return nil, nil, err
 	}
-	for eTarget := range eParents {
-		for sTarget := range sParents {
-			if eTarget == sTarget {
-				return &eTarget, nil, nil
-			}
-		}
-	}
 
-	//LCA
-	eRef, err := e.Save("")
-	if err != nil {
-		return nil, nil, err
-	}
-	sRef, err := sibling.Save("")
-	if err != nil {
-		return nil, nil, err
-	}
-	depth := map[string]int{}
-	depth[eRef] = 0
-	depth[sRef] = 0
+	return newGraphWalker(e.dataStore).lowestCommonAncestor(eRef, sRef)
+}
 
-	childrenE, depth, err := e.dfs(refTree{}, depth, 0)
-	if err != nil {
-		return nil, nil, err
+//lowestCommonAncestor walks both histories from the highest generation down, the first
+//entry reached from both sides is the lowest common ancestor so older history is never visited
+func (w *graphWalker) lowestCommonAncestor(eRef, sRef string) (*string, *lcaMapping, error) {
+	if eRef == sRef {
+		return &eRef, nil, nil
 	}
-	childrenS, depth, err := sibling.dfs(refTree{}, depth, 0)
-	if err != nil {
-		return nil, nil, err
-	}
-
-	commons := findCommon(depth, childrenE, childrenS, eRef, sRef)
 
-	var lca string
-
-	curDepth := MAXDEPTH
-	for ref, nDepth := range commons {
-		if nDepth < curDepth {
-			lca = ref
-			curDepth = nDepth
+	reached := map[string]int{eRef: reachedA, sRef: reachedB}
+	queue := &generationQueue{}
+	for _, ref := range []string{eRef, sRef} {
+		node, err := w.node(ref)
+		if err != nil {
+			return nil, nil, err
 		}
+		heap.Push(queue, generationItem{ref, node.Generation})
 	}
 
-	//Can fast forward
-	if lca == sRef {
-		return &sRef, nil, nil
-	}
+	for queue.Len() > 0 {
+		ref := heap.Pop(queue).(generationItem).ref
+		flags := reached[ref]
 
-	return &lca, &lcaMapping{childrenE, childrenS, depth}, nil
-}
+		if flags == reachedA|reachedB {
+			//Can fast forward
+			if ref == sRef {
+				return &sRef, nil, nil
+			}
 
-func findCommon(depth map[string]int, a refTree, b refTree, eRef string, sRef string) map[string]int {
-	commons := map[string]int{}
+			mapping := &lcaMapping{ReachedA: map[string]bool{}, ReachedB: map[string]bool{}}
+			for rRef, rFlags := range reached {
+				mapping.ReachedA[rRef] = rFlags&reachedA != 0
+				mapping.ReachedB[rRef] = rFlags&reachedB != 0
+			}
+			return &ref, mapping, nil
+		}
 
-	for ref, nodeDepth := range depth {
-		_, okE := a[ref]
-		_, okS := b[ref]
-		if (okE && okS) || (okS && ref == eRef) || (okE && ref == sRef) {
-			commons[ref] = nodeDepth
+		node, err := w.node(ref)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := w.prefetch(node.Parents); err != nil {
+			return nil, nil, err
+		}
+		for _, pRef := range node.Parents {
+			if _, ok := reached[pRef]; !ok {
+				pNode, err := w.node(pRef)
+				if err != nil {
+					return nil, nil, err
+				}
+				heap.Push(queue, generationItem{pRef, pNode.Generation})
+			}
+			reached[pRef] |= flags
 		}
 	}
 
-	return commons
+	return nil, nil, nil
 }
 
-//MAXDEPTH is the limit of the depth of the search
-const MAXDEPTH = 100000
+type generationItem struct {
+	ref        string
+	generation uint64
+}
 
-func (e *Entry) dfs(dfsMap refTree, depth map[string]int, curDepth int) (refTree, map[string]int, error) {
-	ref, _ := e.Save("")
-	parents, err := e.Parents()
-	if err != nil {
-		return nil, nil, err
-	}
+//generationQueue a heap of refs ordered by highest generation first then by ref
+type generationQueue []generationItem
+
+func (q generationQueue) Len() int { return len(q) }
 
-	curDepth++
-	if curDepth > MAXDEPTH {
-		return dfsMap, depth, nil
+func (q generationQueue) Less(i, j int) bool {
+	if q[i].generation != q[j].generation {
+		return q[i].generation > q[j].generation
 	}
+	return q[i].ref < q[j].ref
+}
 
-	for pRef, parent := range parents {
-		dfsMap, depth, err = parent.dfs(dfsMap, depth, curDepth)
-		if err != nil {
-			return nil, nil, err
-		}
+func (q generationQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
 
-		if _, ok := dfsMap[pRef]; !ok {
-			dfsMap[pRef] = map[string]bool{}
-		}
-		dfsMap[pRef][ref] = true
-		if refDef, ok := depth[pRef]; !ok || curDepth > refDef {
-			depth[pRef] = curDepth
-		}
-	}
-	return dfsMap, depth, nil
+func (q *generationQueue) Push(x interface{}) { *q = append(*q, x.(generationItem)) }
+
+func (q *generationQueue) Pop() interface{} {
+	old := *q
+	item := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return item
 }
@@ -10,6 +10,7 @@ import (
 	"fmt"
 	"log"
 	"math/big"
+	mrand "math/rand"
 	"testing"
 	"time"
 
@@ -272,6 +273,7 @@ func TestIPFSSave(t *testing.T) {
 		t.Fatal(err)
 	}
 	entry.Time = nTime
+	entry.Clock = &HLC{Wall: nTime.UnixNano()}
 	entry.EncryptString(origData)
 
 	//Remove authenticators otherwise will always result in a different hash
@@ -279,7 +281,7 @@ func TestIPFSSave(t *testing.T) {
 	entry.Signature = ""
 	entry.ID = uuid.Nil
 
-	expectedHead := "zdpuAwEQfhajYWLX8nk6XmW3cjFtNDAQtMHkZTEgc6mrZHPxN"
+	expectedHead := "zdpuAyYgiBnV1yHhwmmhMYAvRNPNZhfpjVgFTmerqGTdSxYyF"
 
 	head, err := entry.Save("")
 	if err != nil {
@@ -288,6 +290,11 @@ func TestIPFSSave(t *testing.T) {
 	if head != expectedHead {
 		t.Fatalf("Unexpected head, should have been (%s) but got (%s)", expectedHead, head)
 	}
+
+	store := &IpfsStore{Shell: shell}
+	has, err := store.Has(head)
+	assert.NoError(t, err)
+	assert.True(t, has)
 }
 
 func TestNewEntryFromIPFS(t *testing.T) {
@@ -539,9 +546,9 @@ func TestSimpleMerge(t *testing.T) {
 
 	entry1, _ := NewEntry(&Link{rootRef}, *credStore, memStore)
 	entry1.Operation = OpUpSert
-	rec1 := &Record{uuid.New(), []byte(`"Test"`), false}
+	rec1 := &Record{uuid.New(), []byte(`"Test"`), false, nil, nil}
 	entry1Recs := &Records{Records: []Record{*rec1}, store: memStore}
-	entry1Diff := &EntryDiff{OpUpSert, *rec1}
+	entry1Diff := &EntryDiff{OpUpSert, *rec1, nil}
 	entry1Snap, _ := entry1Recs.Snapshot(*credStore)
 	entry1.Snapshot = entry1Snap
 	entry1.EncryptFromJSON(entry1Diff)
@@ -549,9 +556,9 @@ func TestSimpleMerge(t *testing.T) {
 
 	entry2, _ := NewEntry(&Link{rootRef}, *credStore, memStore)
 	entry2.Operation = OpUpSert
-	rec2 := &Record{uuid.New(), []byte(`"Example"`), false}
+	rec2 := &Record{uuid.New(), []byte(`"Example"`), false, nil, nil}
 	entry2Recs := &Records{Records: []Record{*rec2}, store: memStore}
-	entry2Diff := &EntryDiff{OpUpSert, *rec2}
+	entry2Diff := &EntryDiff{OpUpSert, *rec2, nil}
 	entry2Snap, _ := entry2Recs.Snapshot(*credStore)
 	entry2.Snapshot = entry2Snap
 	entry2.EncryptFromJSON(entry2Diff)
@@ -573,7 +580,7 @@ func TestSimpleMerge(t *testing.T) {
 	expectedRefs := []string{entry1Ref, entry2Ref}
 	expectedRecords := []Record{*rec1, *rec2}
 
-	assert.EqualValues(t, expectedRefs, pRefs)
+	assert.ElementsMatch(t, expectedRefs, pRefs)
 	assert.Equal(t, OpMerge, merge.Operation)
 	assert.EqualValues(t, expectedRecords, mRecs)
 }
@@ -609,9 +616,9 @@ func Test2DeepMerge(t *testing.T) {
 
 	entry1, _ := NewEntry(&Link{rootRef}, *credStore, memStore)
 	entry1.Operation = OpUpSert
-	rec1 := &Record{uuid.New(), []byte(`"1"`), false}
+	rec1 := &Record{uuid.New(), []byte(`"1"`), false, nil, nil}
 	entry1Recs := &Records{Records: []Record{*rec1}, store: memStore}
-	entry1Diff := &EntryDiff{OpUpSert, *rec1}
+	entry1Diff := &EntryDiff{OpUpSert, *rec1, nil}
 	entry1Snap, _ := entry1Recs.Snapshot(*credStore)
 	entry1.Snapshot = entry1Snap
 	entry1.EncryptFromJSON(entry1Diff)
@@ -619,9 +626,9 @@ func Test2DeepMerge(t *testing.T) {
 
 	entry2, _ := NewEntry(&Link{rootRef}, *credStore, memStore)
 	entry2.Operation = OpUpSert
-	rec2 := &Record{uuid.New(), []byte(`"2"`), false}
+	rec2 := &Record{uuid.New(), []byte(`"2"`), false, nil, nil}
 	entry2Recs := &Records{Records: []Record{*rec2}, store: memStore}
-	entry2Diff := &EntryDiff{OpUpSert, *rec2}
+	entry2Diff := &EntryDiff{OpUpSert, *rec2, nil}
 	entry2Snap, _ := entry2Recs.Snapshot(*credStore)
 	entry2.Snapshot = entry2Snap
 	entry2.EncryptFromJSON(entry2Diff)
@@ -629,9 +636,9 @@ func Test2DeepMerge(t *testing.T) {
 
 	entry3, _ := NewEntry(&Link{entry1Ref}, *credStore, memStore)
 	entry3.Operation = OpDel
-	rec3 := &Record{rec1.ID, nil, true}
+	rec3 := &Record{rec1.ID, nil, true, nil, nil}
 	entry3Recs := &Records{Records: []Record{*rec3}, store: memStore}
-	entry3Diff := &EntryDiff{OpDel, *rec3}
+	entry3Diff := &EntryDiff{OpDel, *rec3, nil}
 	entry3Snap, err := entry3Recs.Snapshot(*credStore)
 	if err != nil {
 		t.Fatal(err)
@@ -648,9 +655,9 @@ func Test2DeepMerge(t *testing.T) {
 
 	entry5, _ := NewEntry(&Link{entry4Ref}, *credStore, memStore)
 	entry5.Operation = OpUpSert
-	rec5 := &Record{uuid.New(), []byte(`"5"`), false}
+	rec5 := &Record{uuid.New(), []byte(`"5"`), false, nil, nil}
 	entry5Recs := &Records{Records: []Record{*rec5}, store: memStore}
-	entry5Diff := &EntryDiff{OpUpSert, *rec5}
+	entry5Diff := &EntryDiff{OpUpSert, *rec5, nil}
 	entry5Snap, _ := entry5Recs.Snapshot(*credStore)
 	entry5.Snapshot = entry5Snap
 	entry5.EncryptFromJSON(entry5Diff)
@@ -661,10 +668,311 @@ func Test2DeepMerge(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	expectedRecords := []Record{*rec3, *rec2, *rec5}
+	expectedRecords := []Record{{ID: rec3.ID, Deleted: true, DeletedAt: entry3.Clock}, *rec2, *rec5}
 
 	for i := range expectedRecords {
 		assert.EqualValues(t, expectedRecords[i], mRecs[i])
 	}
 	assert.Equal(t, OpMerge, merge.Operation)
 }
+
+func appendTestEntry(t *testing.T, parent string, diff EntryDiff, credStore CredStore, store StorageEngine) (*Entry, string) {
+	entry, err := NewEntry(&Link{parent}, credStore, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry.Operation = diff.Op
+	entry.EncryptFromJSON(diff)
+	ref, err := entry.Save("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entry, ref
+}
+
+func randomTestDiff(rnd *mrand.Rand, ids []uuid.UUID) EntryDiff {
+	id := ids[rnd.Intn(len(ids))]
+	switch rnd.Intn(4) {
+	case 0:
+		return EntryDiff{Op: OpDel, Record: Record{ID: id, Deleted: true}}
+	case 1:
+		return EntryDiff{Op: OpCRDT, Record: Record{ID: id}, Fields: []FieldOp{NewCounterOp("n", int64(rnd.Intn(10)))}}
+	default:
+		return EntryDiff{Op: OpUpSert, Record: Record{ID: id, Raw: []byte(fmt.Sprintf(`%d`, rnd.Intn(100)))}}
+	}
+}
+
+func TestMergeConvergence(t *testing.T) {
+	/*
+		Test:
+			     (B)root
+			      /  \
+			     /    \
+			  A(1..n)  B(1..n)	~ random upserts/deletes/counters over shared records
+
+		A.Merge(B) and B.Merge(A) must produce identical records
+	*/
+
+	for seed := int64(1); seed <= 10; seed++ {
+		t.Run(fmt.Sprintf("seed %d", seed), func(t *testing.T) {
+			rnd := mrand.New(mrand.NewSource(seed))
+			memStore := NewMemStore()
+			credA := *generateTestCredStore()
+			credB := *generateTestCredStore()
+
+			ids := []uuid.UUID{uuid.New(), uuid.New(), uuid.New()}
+
+			root, _ := NewEntry(nil, credA, memStore)
+			root.Operation = OpBase
+			rootRef, _ := root.Save("")
+
+			var headA, headB *Entry
+			refA, refB := rootRef, rootRef
+			for i := 0; i < 3+rnd.Intn(5); i++ {
+				headA, refA = appendTestEntry(t, refA, randomTestDiff(rnd, ids), credA, memStore)
+			}
+			for i := 0; i < 3+rnd.Intn(5); i++ {
+				headB, refB = appendTestEntry(t, refB, randomTestDiff(rnd, ids), credB, memStore)
+			}
+
+			_, recsAB, err := headA.Merge(headB)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, recsBA, err := headB.Merge(headA)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			assert.NotEmpty(t, recsAB)
+			assert.EqualValues(t, recsAB, recsBA)
+		})
+	}
+}
+
+func TestMergeMany(t *testing.T) {
+	/*
+		Test:
+				 (B)root
+				 /  |  \
+				/   |   \
+			 A(C)  B(C)  C(U)
+			    .   |   .
+			      . | .
+			      merge
+
+		Counter increments on all three branches sum, order of heads does not matter
+	*/
+
+	memStore := NewMemStore()
+	credStore := *generateTestCredStore()
+	counterID := uuid.New()
+	recID := uuid.New()
+
+	root, _ := NewEntry(nil, credStore, memStore)
+	root.Operation = OpBase
+	rootRef, _ := root.Save("")
+
+	headA, refA := appendTestEntry(t, rootRef, EntryDiff{Op: OpCRDT, Record: Record{ID: counterID}, Fields: []FieldOp{NewCounterOp("n", 1)}}, credStore, memStore)
+	headB, refB := appendTestEntry(t, rootRef, EntryDiff{Op: OpCRDT, Record: Record{ID: counterID}, Fields: []FieldOp{NewCounterOp("n", 2)}}, credStore, memStore)
+	headC, refC := appendTestEntry(t, rootRef, EntryDiff{Op: OpUpSert, Record: Record{ID: recID, Raw: []byte(`"C"`)}}, credStore, memStore)
+
+	merge, mRecs, err := MergeMany(headA, headB, headC)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, OpMerge, merge.Operation)
+	assert.Equal(t, []*Link{{refA}, {refB}, {refC}}, merge.Parent)
+	assert.Len(t, mRecs, 2)
+	assert.Equal(t, int64(3), mRecs[0].Counter("n"))
+	assert.Equal(t, []byte(`"C"`), []byte(mRecs[1].Raw))
+
+	_, reversed, err := MergeMany(headC, headB, headA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.EqualValues(t, mRecs, reversed)
+
+	_, _, err = MergeMany(headA, headA)
+	assert.Error(t, err)
+
+	_, _, err = MergeMany(headA)
+	assert.Error(t, err)
+}
+
+func TestMergeWithoutSnapshots(t *testing.T) {
+	/*
+		Test:
+			(B)root
+			   |
+			(U)entry 1
+			   |
+			(U)entry 2
+			  /  \
+			 /    \
+		(U)entry 3  (D)entry 4
+			 .    .
+			   ..
+			  merge
+
+		No entry has a snapshot, so the state at the LCA (entry 2) is replayed from the root
+	*/
+
+	memStore := NewMemStore()
+	credStore := *generateTestCredStore()
+
+	rec1 := Record{ID: uuid.New(), Raw: []byte(`"1"`)}
+	rec2 := Record{ID: uuid.New(), Raw: []byte(`"2"`)}
+	rec3 := Record{ID: uuid.New(), Raw: []byte(`"3"`)}
+
+	root, _ := NewEntry(nil, credStore, memStore)
+	root.Operation = OpBase
+	rootRef, _ := root.Save("")
+
+	_, entry1Ref := appendTestEntry(t, rootRef, EntryDiff{Op: OpUpSert, Record: rec1}, credStore, memStore)
+	_, entry2Ref := appendTestEntry(t, entry1Ref, EntryDiff{Op: OpUpSert, Record: rec2}, credStore, memStore)
+	entry3, _ := appendTestEntry(t, entry2Ref, EntryDiff{Op: OpUpSert, Record: rec3}, credStore, memStore)
+	entry4, _ := appendTestEntry(t, entry2Ref, EntryDiff{Op: OpDel, Record: Record{ID: rec1.ID, Deleted: true}}, credStore, memStore)
+
+	_, mRecs, err := entry3.Merge(entry4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedRecords := []Record{{ID: rec1.ID, Deleted: true, DeletedAt: entry4.Clock}, rec2, rec3}
+	assert.EqualValues(t, expectedRecords, mRecs)
+}
+
+func TestRecordsAtNearestSnapshot(t *testing.T) {
+	memStore := NewMemStore()
+	credStore := *generateTestCredStore()
+
+	rec1 := Record{ID: uuid.New(), Raw: []byte(`"1"`)}
+	rec2 := Record{ID: uuid.New(), Raw: []byte(`"2"`)}
+
+	root, _ := NewEntry(nil, credStore, memStore)
+	root.Operation = OpBase
+	rootRef, _ := root.Save("")
+
+	//Snapshot holds more than the diff so it must be the source of the state
+	entry1, _ := NewEntry(&Link{rootRef}, credStore, memStore)
+	entry1.Snapshot, _ = (&Records{Records: []Record{rec1, rec2}, store: memStore}).Snapshot(credStore)
+	entry1.EncryptFromJSON(EntryDiff{Op: OpUpSert, Record: rec1})
+	entry1Ref, _ := entry1.Save("")
+
+	entry2, entry2Ref := appendTestEntry(t, entry1Ref, EntryDiff{Op: OpDel, Record: Record{ID: rec2.ID, Deleted: true}}, credStore, memStore)
+
+	records, err := entry2.recordsAt(entry2Ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.ElementsMatch(t, []Record{rec1, {ID: rec2.ID, Deleted: true, DeletedAt: entry2.Clock}}, records.Records)
+}
+
+type countingStore struct {
+	*MemStore
+	gets int
+}
+
+func (c *countingStore) Get(entry *Entry, ref string) (*Entry, error) {
+	c.gets++
+	return c.MemStore.Get(entry, ref)
+}
+
+func TestAncestorSearchStopsAtLCA(t *testing.T) {
+	/*
+		Test:
+			root - 1 - 2 - ... - 50
+			                      /\
+			                     a1  b1
+			                     |   |
+			                     a2  b2
+
+		LCA(a2, b2) = 50 without visiting the chain below it
+	*/
+
+	store := &countingStore{MemStore: NewMemStore()}
+	credStore := *generateTestCredStore()
+
+	root, _ := NewEntry(nil, credStore, store)
+	root.Operation = OpBase
+	ref, _ := root.Save("")
+	assert.Equal(t, uint64(1), root.Generation)
+
+	for i := 0; i < 50; i++ {
+		entry, _ := NewEntry(&Link{ref}, credStore, store)
+		ref, _ = entry.Save("")
+	}
+	forkRef := ref
+
+	a1, _ := NewEntry(&Link{forkRef}, credStore, store)
+	a1Ref, _ := a1.Save("")
+	a2, _ := NewEntry(&Link{a1Ref}, credStore, store)
+	a2.Save("")
+
+	b1, _ := NewEntry(&Link{forkRef}, credStore, store)
+	b1Ref, _ := b1.Save("")
+	b2, _ := NewEntry(&Link{b1Ref}, credStore, store)
+	b2.Save("")
+
+	assert.Equal(t, uint64(53), a2.Generation)
+
+	store.gets = 0
+	lca, _, err := a2.findCommonAncestor(b2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, forkRef, *lca)
+	assert.True(t, store.gets <= 3, "fetched %d entries", store.gets)
+}
+
+//appendLegacyEntry stores an entry the way it was written before clocks and generations
+func appendLegacyEntry(t *testing.T, parent *Link, diff EntryDiff, credStore CredStore, store StorageEngine) string {
+	entry, err := NewEntry(parent, credStore, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry.Operation = diff.Op
+	entry.EncryptFromJSON(diff)
+	ref, err := store.Save(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ref
+}
+
+func TestLoadedEntryKeepsRef(t *testing.T) {
+	store := NewMemStore()
+	credStore := *generateTestCredStore()
+
+	rootRef := appendLegacyEntry(t, nil, EntryDiff{Op: OpBase}, credStore, store)
+	aRef := appendLegacyEntry(t, &Link{rootRef}, upsertDiff(uuid.New(), `1`), credStore, store)
+	bRef := appendLegacyEntry(t, &Link{rootRef}, upsertDiff(uuid.New(), `2`), credStore, store)
+
+	a, err := NewEntryFromStorage(store, credStore, aRef)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewEntryFromStorage(store, credStore, bRef)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ref, err := a.storedRef()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, aRef, ref)
+	assert.Nil(t, a.Clock)
+
+	//Saving a loaded entry again does not stamp it
+	ref, err = b.Save("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, bRef, ref)
+	assert.Zero(t, b.Generation)
+}
@@ -0,0 +1,347 @@
+package otlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"sort"
+	"sync/atomic"
+
+	"github.com/google/uuid"
+)
+
+//DefaultSubscriptionBuffer the number of events a subscription holds before dropping new ones
+const DefaultSubscriptionBuffer = 64
+
+//ChangeEvent a change to a record made by the head moving, whether by a local write, a merge or
+//following a remote head
+type ChangeEvent struct {
+	RecordID uuid.UUID
+
+	//Operation OpUpSert for inserts and updates, OpDel for deletes
+	Operation Operation
+
+	//Old the record before the change, nil when inserted
+	Old json.RawMessage
+
+	//New the record after the change, nil when deleted
+	New json.RawMessage
+
+	//Ref the head entry the change was made by
+	Ref string
+}
+
+//ChangeFilter selects the events a subscription receives
+type ChangeFilter func(ChangeEvent) bool
+
+//Subscription receives change events from a log on C. Events are never blocked on, when C is full new
+//events are dropped and counted so the subscriber knows to reread the records
+type Subscription struct {
+	C <-chan ChangeEvent
+
+	log     *Log
+	c       chan ChangeEvent
+	filter  ChangeFilter
+	dropped uint64
+}
+
+//Dropped the number of events dropped because C was full, or head moves whose changes could not be read
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+//Unsubscribe stops events and closes C, it is safe to call more than once
+func (s *Subscription) Unsubscribe() {
+	l := s.log
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.subs[s] {
+		return
+	}
+	delete(l.subs, s)
+	close(s.c)
+	if len(l.subs) == 0 {
+		l.watched = nil
+	}
+}
+
+//watchState the records at head, tombstones included, kept while there are subscribers to diff head moves
+//against. It is read in full once and then updated with the records each move touches
+type watchState struct {
+	head    string
+	records map[uuid.UUID]Record
+}
+
+//Subscribe receives events for every record change passing filter, a nil filter passes all
+func (l *Log) Subscribe(filter ChangeFilter) *Subscription {
+	return l.SubscribeBuffered(filter, DefaultSubscriptionBuffer)
+}
+
+//SubscribeBuffered as Subscribe with C holding up to buffer events
+func (l *Log) SubscribeBuffered(filter ChangeFilter, buffer int) *Subscription {
+	c := make(chan ChangeEvent, buffer)
+	sub := &Subscription{C: c, log: l, c: c, filter: filter}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.subs == nil {
+		l.subs = map[*Subscription]bool{}
+	}
+	l.subs[sub] = true
+	return sub
+}
+
+//setHead sets the head, notifying subscribers of the records it changed. The head always moves, when
+//the changes can not be worked out every subscription counts a dropped event instead
+func (l *Log) setHead(head string) {
+	old := l.head
+	l.head = head
+	if old == head {
+		return
+	}
+	l.moved = true
+	if len(l.subs) == 0 {
+		return
+	}
+
+	events, err := l.headChanges(old, head)
+	if err != nil {
+		l.watched = nil
+		for sub := range l.subs {
+			atomic.AddUint64(&sub.dropped, 1)
+		}
+		return
+	}
+
+	for _, ev := range events {
+		for sub := range l.subs {
+			if sub.filter != nil && !sub.filter(ev) {
+				continue
+			}
+			select {
+			case sub.c <- ev:
+			default:
+				atomic.AddUint64(&sub.dropped, 1)
+			}
+		}
+	}
+}
+
+//headChanges the changes made moving the head from old. Only the records touched by entries on either
+//side since the common ancestor can differ, local writes and fast-forwards replay their diffs onto the
+//watched records and anything else reads the touched records at head
+func (l *Log) headChanges(old, head string) ([]ChangeEvent, error) {
+	if l.watched == nil || l.watched.head != old {
+		records, err := l.recordMap(old)
+		if err != nil {
+			return nil, err
+		}
+		l.watched = &watchState{head: old, records: records}
+	}
+	if old == "" {
+		records, err := l.recordMap(head)
+		if err != nil {
+			return nil, err
+		}
+		events := changeEvents(l.watched.records, records, head)
+		l.watched = &watchState{head: head, records: records}
+		return events, nil
+	}
+
+	walker := newGraphWalker(l.store)
+	base, _, err := walker.lowestCommonAncestor(old, head)
+	if err != nil {
+		return nil, err
+	}
+	if base == nil {
+		return nil, errors.New("no common ancestor")
+	}
+
+	forward, merged, err := l.playedSince(walker, head, *base)
+	if err != nil {
+		return nil, err
+	}
+	backward, _, err := l.playedSince(walker, old, *base)
+	if err != nil {
+		return nil, err
+	}
+
+	touched := map[uuid.UUID]bool{}
+	prior := map[uuid.UUID]Record{}
+	for _, played := range append(forward, backward...) {
+		id := played.diff.Record.ID
+		touched[id] = true
+		if rec, ok := l.watched.records[id]; ok {
+			prior[id] = rec
+		}
+	}
+
+	var next map[uuid.UUID]Record
+	if *base == old && !merged {
+		current := []Record{}
+		for _, rec := range prior {
+			current = append(current, rec)
+		}
+		view := l.view()
+		for _, played := range forward {
+			if current, err = view.applyDiff(played.diff, played.at, played.parents, current); err != nil {
+				return nil, err
+			}
+		}
+		next = map[uuid.UUID]Record{}
+		for _, rec := range current {
+			next[rec.ID] = rec
+		}
+	} else if next, err = l.recordsFor(walker, head, touched); err != nil {
+		return nil, err
+	}
+
+	for id := range touched {
+		if rec, ok := next[id]; ok {
+			l.watched.records[id] = rec
+		} else {
+			delete(l.watched.records, id)
+		}
+	}
+	l.watched.head = head
+	return changeEvents(prior, next, head), nil
+}
+
+//playedDiff a diff with the clock and parents it was written at
+type playedDiff struct {
+	diff    EntryDiff
+	at      HLC
+	parents []string
+}
+
+//playedSince the diffs written since base in playback order, and whether a merge is among them
+func (l *Log) playedSince(walker *graphWalker, head, base string) ([]playedDiff, bool, error) {
+	if head == base {
+		return nil, false, nil
+	}
+	refs, err := walker.since([]string{head}, base)
+	if err != nil {
+		return nil, false, err
+	}
+	entries, err := fetchEntries(l.store, l.credStore, refs)
+	if err != nil {
+		return nil, false, err
+	}
+
+	played := []playedDiff{}
+	merged := false
+	for _, entry := range playbackOrder(entries) {
+		if entry.Operation == OpMerge {
+			merged = true
+		}
+		if !entry.Operation.hasDiff() {
+			continue
+		}
+		diff, err := entry.DataToStruct(&EntryDiff{})
+		if err != nil {
+			return nil, false, err
+		}
+		played = append(played, playedDiff{diff: *diff.(*EntryDiff), at: entry.clock(), parents: entry.parentRefs()})
+	}
+	return played, merged, nil
+}
+
+//recordsFor the records with the given IDs at head, looked up in the nearest snapshot and replayed since
+func (l *Log) recordsFor(walker *graphWalker, head string, ids map[uuid.UUID]bool) (map[uuid.UUID]Record, error) {
+	snapshotRef, snapshotTarget, err := walker.nearestSnapshot(head)
+	if err != nil {
+		return nil, err
+	}
+
+	current := []Record{}
+	if snapshotTarget != "" {
+		snapshot, err := RecoverSnapshot(snapshotTarget, l.store)
+		if err != nil {
+			return nil, err
+		}
+		for id := range ids {
+			rec, err := snapshot.GetRecord(l.credStore, id)
+			if err == ErrRecordNotFound {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			current = append(current, *rec)
+		}
+	}
+
+	played, _, err := l.playedSince(walker, head, snapshotRef)
+	if err != nil {
+		return nil, err
+	}
+	view := l.view()
+	for _, p := range played {
+		if !ids[p.diff.Record.ID] {
+			continue
+		}
+		if current, err = view.applyDiff(p.diff, p.at, p.parents, current); err != nil {
+			return nil, err
+		}
+	}
+
+	records := map[uuid.UUID]Record{}
+	for _, rec := range current {
+		records[rec.ID] = rec
+	}
+	return records, nil
+}
+
+//recordMap every record at head by ID, tombstones included
+func (l *Log) recordMap(head string) (map[uuid.UUID]Record, error) {
+	records := map[uuid.UUID]Record{}
+	if head == "" {
+		return records, nil
+	}
+
+	set, err := l.view().recordsAt(head)
+	if err != nil {
+		return nil, err
+	}
+	for _, rec := range set.Records {
+		records[rec.ID] = rec
+	}
+	return records, nil
+}
+
+//changeEvents the changes from old to next records ordered by record ID, tombstones count as absent
+func changeEvents(old, next map[uuid.UUID]Record, ref string) []ChangeEvent {
+	events := []ChangeEvent{}
+	for id, rec := range next {
+		if rec.Deleted {
+			continue
+		}
+		prior, existed := old[id]
+		if !existed || prior.Deleted {
+			events = append(events, ChangeEvent{RecordID: id, Operation: OpUpSert, New: rec.Raw, Ref: ref})
+			continue
+		}
+		if !recordEqual(prior, rec) {
+			events = append(events, ChangeEvent{RecordID: id, Operation: OpUpSert, Old: prior.Raw, New: rec.Raw, Ref: ref})
+		}
+	}
+	for id, rec := range old {
+		if rec.Deleted {
+			continue
+		}
+		if after, ok := next[id]; !ok || after.Deleted {
+			events = append(events, ChangeEvent{RecordID: id, Operation: OpDel, Old: rec.Raw, Ref: ref})
+		}
+	}
+
+	sort.Slice(events, func(i, j int) bool {
+		return bytes.Compare(events[i].RecordID[:], events[j].RecordID[:]) < 0
+	})
+	return events
+}
+
+func recordEqual(a, b Record) bool {
+	aBytes, aErr := json.Marshal(a)
+	bBytes, bErr := json.Marshal(b)
+	return aErr == nil && bErr == nil && bytes.Equal(aBytes, bBytes)
+}
@@ -0,0 +1,149 @@
+package otlog
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubscribe(t *testing.T) {
+	log := newTestLog(t)
+	rec1, rec2 := uuid.New(), uuid.New()
+
+	all := log.Subscribe(nil)
+	only2 := log.Subscribe(func(ev ChangeEvent) bool { return ev.RecordID == rec2 })
+
+	log.Append(upsertDiff(rec1, `1`))
+	log.Append(upsertDiff(rec1, `2`))
+	log.Append(upsertDiff(rec2, `3`))
+	log.Append(EntryDiff{Op: OpDel, Record: Record{ID: rec1}})
+
+	events := []ChangeEvent{}
+	for len(all.C) > 0 {
+		events = append(events, <-all.C)
+	}
+	if !assert.Len(t, events, 4) {
+		t.FailNow()
+	}
+	assert.Equal(t, ChangeEvent{RecordID: rec1, Operation: OpUpSert, New: json.RawMessage(`1`), Ref: events[0].Ref}, events[0])
+	assert.Equal(t, json.RawMessage(`1`), events[1].Old)
+	assert.Equal(t, json.RawMessage(`2`), events[1].New)
+	assert.Equal(t, OpDel, events[3].Operation)
+	assert.Equal(t, json.RawMessage(`2`), events[3].Old)
+	assert.Equal(t, log.Head(), events[3].Ref)
+
+	assert.Len(t, only2.C, 1)
+	assert.Equal(t, rec2, (<-only2.C).RecordID)
+
+	all.Unsubscribe()
+	all.Unsubscribe()
+	log.Append(upsertDiff(rec2, `4`))
+	_, open := <-all.C
+	assert.False(t, open)
+	assert.Len(t, only2.C, 1)
+}
+
+func TestSubscribeMergeAndBackpressure(t *testing.T) {
+	log := newTestLog(t)
+	base := log.Head()
+	log.Append(upsertDiff(uuid.New(), `1`))
+
+	branch := NewLog(log.credStore, log.store, base)
+	remote := uuid.New()
+	branch.Append(upsertDiff(remote, `2`))
+	branch.Append(upsertDiff(uuid.New(), `3`))
+
+	sub := log.SubscribeBuffered(nil, 1)
+	if _, err := log.Merge(branch.Head()); err != nil {
+		t.Fatal(err)
+	}
+
+	//Only the records from the branch changed, one fits the buffer
+	assert.Len(t, sub.C, 1)
+	assert.EqualValues(t, 1, sub.Dropped())
+}
+
+func TestSubscribeTracksRecords(t *testing.T) {
+	log := newTestLog(t)
+	log.Snapshots = SnapshotPolicy{EveryEntries: 2}
+	base := log.Head()
+	rec1, rec2 := uuid.New(), uuid.New()
+	sub := log.SubscribeBuffered(nil, 100)
+
+	//The watched records always match those read in full at the head
+	check := func() {
+		expected, err := log.recordMap(log.Head())
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, _ := json.Marshal(expected)
+		got, _ := json.Marshal(log.watched.records)
+		assert.JSONEq(t, string(want), string(got))
+	}
+
+	log.Append(upsertDiff(rec1, `1`))
+	log.Append(EntryDiff{Op: OpCRDT, Record: Record{ID: rec1}, Fields: []FieldOp{NewCounterOp("n", 2)}})
+	log.Append(EntryDiff{Op: OpDel, Record: Record{ID: rec1}})
+	log.Append(EntryDiff{Op: OpCRDT, Record: Record{ID: rec1}, Fields: []FieldOp{NewCounterOp("n", 1)}})
+	check()
+
+	//Both sides change rec2, the merge reads it from the merge snapshot
+	branch := NewLog(log.credStore, log.store, base)
+	branch.Append(upsertDiff(rec2, `2`))
+	log.Append(upsertDiff(rec2, `3`))
+	if _, err := log.Merge(branch.Head()); err != nil {
+		t.Fatal(err)
+	}
+	check()
+	log.Compact()
+	check()
+
+	//Rebasing moves the head to a chain which does not contain it
+	other := NewLog(log.credStore, log.store, log.Head())
+	other.Append(upsertDiff(rec2, `4`))
+	log.Append(upsertDiff(rec1, `5`))
+	if _, err := log.Rebase(log.Head(), other.Head()); err != nil {
+		t.Fatal(err)
+	}
+	check()
+
+	events := []ChangeEvent{}
+	for len(sub.C) > 0 {
+		events = append(events, <-sub.C)
+	}
+	last := events[len(events)-2:]
+	assert.Equal(t, rec1, last[0].RecordID)
+	assert.Equal(t, json.RawMessage(`5`), last[0].New)
+	assert.Equal(t, rec2, last[1].RecordID)
+	assert.Equal(t, json.RawMessage(`4`), last[1].New)
+	assert.Zero(t, sub.Dropped())
+}
+
+func TestSubscribeNeverFailsWrites(t *testing.T) {
+	log := newTestLog(t)
+	log.Append(upsertDiff(uuid.New(), `1`))
+	checkpoint, _ := log.Compact()
+	store := log.store.(*MemStore)
+
+	broadcaster := NewMemBroadcaster()
+	log.Broadcaster = broadcaster
+	announced, _ := broadcaster.Subscribe()
+	defer announced.Cancel()
+
+	//The records at the head can no longer be read
+	store.Remove(checkpoint.Snapshot.Target)
+	sub := log.Subscribe(nil)
+	if _, err := log.Append(upsertDiff(uuid.New(), `2`)); err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, sub.C)
+	assert.EqualValues(t, 1, sub.Dropped())
+
+	ann, err := announced.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, log.Head(), ann.Head)
+}
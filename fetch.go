@@ -0,0 +1,100 @@
+package otlog
+
+import (
+	"sync"
+)
+
+//DefaultFetchWorkers the number of entries fetched at once when a store does not configure it
+const DefaultFetchWorkers = 8
+
+//ConcurrentStore is a storage engine which allows a number of entries to be fetched at once
+type ConcurrentStore interface {
+	FetchWorkers() int
+}
+
+func fetchWorkers(store StorageEngine) int {
+	if cs, ok := store.(ConcurrentStore); ok && cs.FetchWorkers() > 0 {
+		return cs.FetchWorkers()
+	}
+	return DefaultFetchWorkers
+}
+
+//fetchEach runs fetch for every ref on a bounded pool of workers, results are keyed by ref and the
+//error returned is that of the first failing ref in the given order, regardless of fetch order
+func fetchEach(store StorageEngine, refs []string, fetch func(ref string) (interface{}, error)) (map[string]interface{}, error) {
+	workers := fetchWorkers(store)
+	if workers > len(refs) {
+		workers = len(refs)
+	}
+
+	results := make([]interface{}, len(refs))
+	errs := make([]error, len(refs))
+
+	if workers <= 1 {
+		for i, ref := range refs {
+			results[i], errs[i] = fetch(ref)
+		}
+	} else {
+		jobs := make(chan int)
+		wg := sync.WaitGroup{}
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := range jobs {
+					results[i], errs[i] = fetch(refs[i])
+				}
+			}()
+		}
+		for i := range refs {
+			jobs <- i
+		}
+		close(jobs)
+		wg.Wait()
+	}
+
+	fetched := make(map[string]interface{}, len(refs))
+	for i, ref := range refs {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		fetched[ref] = results[i]
+	}
+	return fetched, nil
+}
+
+//fetchEntries fetches and decrypts entries in parallel
+func fetchEntries(store StorageEngine, credStore CredStore, refs []string) (map[string]*Entry, error) {
+	fetched, err := fetchEach(store, refs, func(ref string) (interface{}, error) {
+		return NewEntryFromStorage(store, credStore, ref)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make(map[string]*Entry, len(fetched))
+	for ref, entry := range fetched {
+		entries[ref] = entry.(*Entry)
+	}
+	return entries, nil
+}
+
+//prefetch loads the graph nodes of refs not yet indexed in parallel
+func (w *graphWalker) prefetch(refs []string) error {
+	missing := []string{}
+	seen := map[string]bool{}
+	for _, ref := range refs {
+		if _, ok := w.graph.Get(ref); !ok && !seen[ref] {
+			seen[ref] = true
+			missing = append(missing, ref)
+		}
+	}
+	if len(missing) < 2 {
+		return nil
+	}
+
+	_, err := fetchEach(w.store, missing, func(ref string) (interface{}, error) {
+		return w.node(ref)
+	})
+	return err
+}
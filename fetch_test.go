@@ -0,0 +1,86 @@
+package otlog
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+//slowStore delays each fetch and records the most fetches in flight at once, once overlapped is set
+//each fetch waits for another to be in flight alongside it
+type slowStore struct {
+	*MemStore
+	mu         sync.Mutex
+	inFlight   int
+	peak       int
+	fail       map[string]bool
+	overlapped chan struct{}
+}
+
+func (s *slowStore) Get(entry *Entry, ref string) (*Entry, error) {
+	s.mu.Lock()
+	s.inFlight++
+	if s.inFlight > s.peak {
+		s.peak = s.inFlight
+	}
+	overlapped := s.overlapped
+	if overlapped != nil && s.inFlight > 1 {
+		close(overlapped)
+		s.overlapped = nil
+	}
+	s.mu.Unlock()
+
+	if overlapped != nil {
+		select {
+		case <-overlapped:
+		case <-time.After(time.Second):
+		}
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	s.mu.Lock()
+	s.inFlight--
+	s.mu.Unlock()
+
+	if s.fail[ref] {
+		return nil, errors.New("Unable to find reference " + ref)
+	}
+	return s.MemStore.Get(entry, ref)
+}
+
+func TestFetchEntriesBounded(t *testing.T) {
+	store := &slowStore{MemStore: NewMemStore(), fail: map[string]bool{}}
+	store.Workers = 3
+	credStore := *generateTestCredStore()
+
+	root, _ := NewEntry(nil, credStore, store)
+	root.Operation = OpBase
+	rootRef, _ := root.Save("")
+
+	refs := []string{}
+	for i := 0; i < 12; i++ {
+		_, ref := appendTestEntry(t, rootRef, EntryDiff{Op: OpUpSert, Record: Record{Raw: []byte(`"x"`)}}, credStore, store)
+		refs = append(refs, ref)
+	}
+
+	store.overlapped = make(chan struct{})
+	entries, err := fetchEntries(store, credStore, refs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, entries, 12)
+	assert.True(t, store.peak > 1, "fetches were not made in parallel")
+	assert.True(t, store.peak <= 3, "peak %d exceeds workers", store.peak)
+	for _, ref := range refs {
+		assert.False(t, entries[ref].isEncrypted)
+	}
+
+	//The first failing ref in order is reported
+	store.fail[refs[7]] = true
+	store.fail[refs[2]] = true
+	_, err = fetchEntries(store, credStore, refs)
+	assert.EqualValues(t, "Unable to find reference "+refs[2], err.Error())
+}
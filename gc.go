@@ -0,0 +1,120 @@
+package otlog
+
+import (
+	"fmt"
+	"sort"
+)
+
+//Collectable is a storage engine which can list and remove what it holds
+type Collectable interface {
+	//Refs every entry, snapshot and shard held
+	Refs() ([]string, error)
+
+	//Remove drops the refs from storage
+	Remove(refs ...string) error
+}
+
+//GCReport the outcome of a garbage collection
+type GCReport struct {
+	DryRun    bool
+	Reachable int
+	Removed   []string
+}
+
+//CollectGarbage marks every entry, snapshot and shard reachable from the root refs (usually the
+//branch heads) and removes the rest from the store, a dry run only reports what would be removed.
+//Writers must be stopped while collecting, an entry saved after marking would be removed
+func CollectGarbage(store StorageEngine, roots []string, dryRun bool) (*GCReport, error) {
+	collectable, ok := store.(Collectable)
+	if !ok {
+		return nil, fmt.Errorf("%T does not support garbage collection", store)
+	}
+
+	marked, err := markReachable(store, roots)
+	if err != nil {
+		return nil, err
+	}
+
+	refs, err := collectable.Refs()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(refs)
+
+	report := &GCReport{DryRun: dryRun, Reachable: len(marked), Removed: []string{}}
+	for _, ref := range refs {
+		if !marked[ref] {
+			report.Removed = append(report.Removed, ref)
+		}
+	}
+	if !dryRun && len(report.Removed) > 0 {
+		if err := collectable.Remove(report.Removed...); err != nil {
+			return nil, err
+		}
+	}
+	return report, nil
+}
+
+//markReachable the refs reachable from the roots, history already pruned behind a checkpoint is skipped
+func markReachable(store StorageEngine, roots []string) (map[string]bool, error) {
+	marked := map[string]bool{}
+	walker := newGraphWalker(store)
+
+	stack := append([]string{}, roots...)
+	for len(stack) > 0 {
+		ref := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if marked[ref] {
+			continue
+		}
+
+		node, err := walker.node(ref)
+		if err == ErrHistoryPruned {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		marked[ref] = true
+
+		if node.Snapshot != "" && !marked[node.Snapshot] {
+			if err := markSnapshot(store, node.Snapshot, marked); err != nil {
+				return nil, err
+			}
+		}
+		stack = append(stack, node.Parents...)
+	}
+
+	return marked, nil
+}
+
+//markSnapshot marks the snapshot and the trie nodes it links
+func markSnapshot(store StorageEngine, ref string, marked map[string]bool) error {
+	snapshot, err := RecoverSnapshot(ref, store)
+	if err != nil {
+		return err
+	}
+	marked[ref] = true
+
+	if snapshot.Root == nil {
+		return nil
+	}
+	stack := []TrieLink{*snapshot.Root}
+	for len(stack) > 0 {
+		link := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if marked[link.Link.Target] {
+			//Shared subtrees were marked through an earlier snapshot
+			continue
+		}
+		marked[link.Link.Target] = true
+
+		if !link.Leaf {
+			node, err := store.GetShard(link.Link.Target)
+			if err != nil {
+				return err
+			}
+			stack = append(stack, node.Children...)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package otlog
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCollectGarbage(t *testing.T) {
+	log := newTestLog(t)
+	store := log.store.(*MemStore)
+	log.Snapshots = SnapshotPolicy{EveryEntries: 2}
+	rootRef := log.Head()
+
+	log.Append(upsertDiff(uuid.New(), `1`))
+	log.Append(upsertDiff(uuid.New(), `2`))
+
+	//A branch which is rebased, orphaning its original entries and snapshots
+	branch := NewLog(log.credStore, store, rootRef)
+	branch.Snapshots = log.Snapshots
+	branch.Append(upsertDiff(uuid.New(), `3`))
+	branch.Append(upsertDiff(uuid.New(), `4`))
+	orphan := branch.Head()
+	if _, err := branch.Rebase(orphan, log.Head()); err != nil {
+		t.Fatal(err)
+	}
+
+	before, _ := store.Refs()
+	report, err := CollectGarbage(store, []string{branch.Head()}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, report.DryRun)
+	assert.Contains(t, report.Removed, orphan)
+	after, _ := store.Refs()
+	assert.Len(t, after, len(before))
+
+	report, err = CollectGarbage(store, []string{branch.Head()}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, _ = store.Refs()
+	assert.Len(t, after, len(before)-len(report.Removed))
+	assert.Equal(t, report.Reachable, len(after))
+	_, ok := store.Entries[orphan]
+	assert.False(t, ok)
+
+	//Everything left is still readable
+	records, err := NewLog(log.credStore, store, branch.Head()).Records()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, records, 4)
+
+	//Nothing more to collect
+	report, _ = CollectGarbage(store, []string{branch.Head()}, false)
+	assert.Empty(t, report.Removed)
+}
+
+func TestCollectGarbageAfterPrune(t *testing.T) {
+	log := newTestLog(t)
+	store := log.store.(*MemStore)
+
+	log.Append(upsertDiff(uuid.New(), `1`))
+	log.Compact()
+	log.Append(upsertDiff(uuid.New(), `2`))
+
+	prunable, _ := log.Prunable()
+	for _, ref := range prunable {
+		store.Remove(ref)
+	}
+
+	report, err := CollectGarbage(store, []string{log.Head()}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, report.Removed)
+
+	_, err = CollectGarbage(&headerStore{StorageEngine: store}, []string{log.Head()}, false)
+	assert.Error(t, err)
+}
+
+func TestCollectGarbageAfterPruneWithSnapshots(t *testing.T) {
+	log := newTestLog(t)
+	log.Snapshots = SnapshotPolicy{EveryEntries: 1}
+	store := log.store.(*MemStore)
+
+	for i := 0; i < 3; i++ {
+		log.Append(upsertDiff(uuid.New(), `1`))
+	}
+	log.Compact()
+	id := uuid.New()
+	log.Append(upsertDiff(id, `2`))
+
+	prunable, _ := log.Prunable()
+	for _, ref := range prunable {
+		store.Remove(ref)
+		_, indexed := store.Index.Get(ref)
+		assert.False(t, indexed)
+	}
+
+	//Snapshots of the pruned entries are no longer reachable
+	report, err := CollectGarbage(store, []string{log.Head()}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotEmpty(t, report.Removed)
+	refs, _ := store.Refs()
+	assert.Equal(t, report.Reachable, len(refs))
+
+	report, err = CollectGarbage(store, []string{log.Head()}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, report.Removed)
+
+	records, err := NewLog(log.credStore, store, log.Head()).Records()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, records, 4)
+	for _, rec := range records {
+		if rec.ID == id {
+			assert.Equal(t, `2`, string(rec.Raw))
+		}
+	}
+}
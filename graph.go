@@ -0,0 +1,393 @@
+package otlog
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+//ErrHistoryPruned history behind a checkpoint was needed but has been dropped from storage
+var ErrHistoryPruned = errors.New("History behind checkpoint has been pruned")
+
+//GraphNode the DAG metadata of an entry, enough to walk history without decrypting payloads
+type GraphNode struct {
+	Ref        string    `json:"r"`
+	Parents    []string  `json:"p,omitempty"`
+	Generation uint64    `json:"g"`
+	Time       time.Time `json:"t"`
+	Clock      *HLC      `json:"h,omitempty"`
+	Operation  Operation `json:"o"`
+	Snapshot   string    `json:"sn,omitempty"`
+}
+
+//GraphStore is a storage engine which keeps a commit-graph index of the entries it holds
+type GraphStore interface {
+	Graph() *GraphIndex
+}
+
+//GraphIndex caches the DAG metadata of entries by ref, as entries are content addressed
+//nodes never change once added
+type GraphIndex struct {
+	mu    sync.RWMutex
+	nodes map[string]*GraphNode
+	path  string
+	file  *os.File
+}
+
+//NewGraphIndex creates an in memory graph index
+func NewGraphIndex() *GraphIndex {
+	return &GraphIndex{nodes: map[string]*GraphNode{}}
+}
+
+//OpenGraphIndex loads a graph index persisted at path, new nodes are appended to the file as they are added
+func OpenGraphIndex(path string) (*GraphIndex, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	g := NewGraphIndex()
+	reader := bufio.NewReader(file)
+	good := int64(0)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			file.Close()
+			return nil, err
+		}
+
+		node := &GraphNode{}
+		if err := json.Unmarshal(line, node); err != nil {
+			break
+		}
+		g.nodes[node.Ref] = node
+		good += int64(len(line))
+	}
+
+	//Drop a partially written trailing node so appends start on a fresh line, it is re-added when next seen
+	if err := file.Truncate(good); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	g.path, g.file = path, file
+	return g, nil
+}
+
+//Close closes the persisted index file
+func (g *GraphIndex) Close() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.file == nil {
+		return nil
+	}
+	err := g.file.Close()
+	g.file = nil
+	return err
+}
+
+//Get the node for ref if indexed
+func (g *GraphIndex) Get(ref string) (*GraphNode, bool) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	node, ok := g.nodes[ref]
+	return node, ok
+}
+
+//Len the number of indexed nodes
+func (g *GraphIndex) Len() int {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	return len(g.nodes)
+}
+
+//Add indexes the entry stored at ref
+func (g *GraphIndex) Add(ref string, entry *Entry) (*GraphNode, error) {
+	if node, ok := g.Get(ref); ok {
+		return node, nil
+	}
+
+	node := newGraphNode(ref, entry)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if existing, ok := g.nodes[ref]; ok {
+		return existing, nil
+	}
+	g.nodes[ref] = node
+
+	if g.file != nil {
+		line, err := json.Marshal(node)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := g.file.Write(append(line, '\n')); err != nil {
+			return nil, err
+		}
+	}
+
+	return node, nil
+}
+
+//Remove drops the nodes for the refs, such as when entries are removed from storage, a persisted
+//index is rewritten once without them
+func (g *GraphIndex) Remove(refs ...string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	removed := false
+	for _, ref := range refs {
+		if _, ok := g.nodes[ref]; ok {
+			delete(g.nodes, ref)
+			removed = true
+		}
+	}
+	if !removed || g.file == nil {
+		return nil
+	}
+
+	file, err := rewriteFile(g.file, g.path, func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		for _, node := range g.nodes {
+			if err := enc.Encode(node); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	g.file = file
+	return err
+}
+
+//rewriteFile replaces the file at path with what write gives, via a temporary file renamed over it so
+//a crash leaves either the old or new contents, giving the new file opened for appends
+func rewriteFile(file *os.File, path string, write func(w io.Writer) error) (*os.File, error) {
+	tmp, err := os.OpenFile(path+".tmp", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return file, err
+	}
+	writer := bufio.NewWriter(tmp)
+	if err := write(writer); err != nil {
+		tmp.Close()
+		return file, err
+	}
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+		return file, err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return file, err
+	}
+	if err := tmp.Close(); err != nil {
+		return file, err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return file, err
+	}
+
+	file.Close()
+	return os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0600)
+}
+
+func newGraphNode(ref string, entry *Entry) *GraphNode {
+	node := &GraphNode{
+		Ref:        ref,
+		Generation: entry.Generation,
+		Time:       entry.Time,
+		Clock:      entry.Clock,
+		Operation:  entry.Operation,
+	}
+	for _, parent := range entry.Parent {
+		if parent != nil {
+			node.Parents = append(node.Parents, parent.Target)
+		}
+	}
+	if entry.Snapshot != nil {
+		node.Snapshot = entry.Snapshot.Target
+	}
+	return node
+}
+
+//clock the nodes HLC, falling back to wall clock time for entries written without one
+func (n *GraphNode) clock() HLC {
+	if n.Clock == nil {
+		return HLC{Wall: n.Time.UnixNano()}
+	}
+	return *n.Clock
+}
+
+//storeGraph the index kept by the store, if any
+func storeGraph(store StorageEngine) *GraphIndex {
+	if gs, ok := store.(GraphStore); ok {
+		return gs.Graph()
+	}
+	return nil
+}
+
+//graphWalker resolves graph nodes for a traversal, using the stores index when it has one
+//and otherwise fetching entry headers without decrypting them
+type graphWalker struct {
+	store StorageEngine
+	graph *GraphIndex
+
+	mu sync.Mutex
+	//behind refs reached through a checkpoint, which may have been pruned
+	behind map[string]bool
+	//generations derived for entries written before generations were recorded
+	generations map[string]uint64
+}
+
+func newGraphWalker(store StorageEngine) *graphWalker {
+	graph := storeGraph(store)
+	if graph == nil {
+		graph = NewGraphIndex()
+	}
+	return &graphWalker{store: store, graph: graph, behind: map[string]bool{}, generations: map[string]uint64{}}
+}
+
+//node the graph node for ref, entries written before generations were recorded are given
+//one more than the highest generation of their parents
+func (w *graphWalker) node(ref string) (*GraphNode, error) {
+	node, err := w.fetch(ref)
+	if err != nil {
+		return nil, err
+	}
+	generation, known := w.knownGeneration(node)
+	if !known {
+		if generation, err = w.deriveGeneration(node); err != nil {
+			return nil, err
+		}
+	}
+	if generation == node.Generation {
+		return node, nil
+	}
+
+	derived := *node
+	derived.Generation = generation
+	return &derived, nil
+}
+
+//deriveGeneration works out the generation of a legacy node from its ancestors, iteratively
+//as legacy chains may be long, parents which have been pruned are skipped
+func (w *graphWalker) deriveGeneration(node *GraphNode) (uint64, error) {
+	stack := []*GraphNode{node}
+	for len(stack) > 0 {
+		top := stack[len(stack)-1]
+		generation, pending := uint64(0), false
+		for _, pRef := range top.Parents {
+			parent, err := w.fetch(pRef)
+			if err == ErrHistoryPruned {
+				continue
+			} else if err != nil {
+				return 0, err
+			}
+			pGen, known := w.knownGeneration(parent)
+			if !known {
+				stack = append(stack, parent)
+				pending = true
+				continue
+			}
+			if pGen > generation {
+				generation = pGen
+			}
+		}
+		if pending {
+			continue
+		}
+
+		stack = stack[:len(stack)-1]
+		w.mu.Lock()
+		w.generations[top.Ref] = generation + 1
+		w.mu.Unlock()
+	}
+
+	generation, _ := w.knownGeneration(node)
+	return generation, nil
+}
+
+//observes whether the entry written at clock is in the history of parents, only entries written after
+//it are searched as each entry is clocked after its parents
+func (w *graphWalker) observes(parents []string, clock HLC) (bool, error) {
+	visited := map[string]bool{}
+	stack := append([]string{}, parents...)
+	for len(stack) > 0 {
+		ref := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if visited[ref] {
+			continue
+		}
+		visited[ref] = true
+
+		node, err := w.node(ref)
+		if err == ErrHistoryPruned {
+			continue
+		} else if err != nil {
+			return false, err
+		}
+		switch c := node.clock().Compare(clock); {
+		case c == 0:
+			return true, nil
+		case c > 0:
+			stack = append(stack, node.Parents...)
+		}
+	}
+	return false, nil
+}
+
+//knownGeneration the recorded or already derived generation of node
+func (w *graphWalker) knownGeneration(node *GraphNode) (uint64, bool) {
+	if node.Generation != 0 || len(node.Parents) == 0 {
+		return node.Generation, true
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	generation, ok := w.generations[node.Ref]
+	return generation, ok
+}
+
+//fetch the graph node for ref as it was stored
+func (w *graphWalker) fetch(ref string) (*GraphNode, error) {
+	node, ok := w.graph.Get(ref)
+	if !ok {
+		entry, err := w.store.Get(&Entry{dataStore: w.store, isEncrypted: true}, ref)
+		if err != nil {
+			if w.isBehind(ref) {
+				return nil, ErrHistoryPruned
+			}
+			return nil, err
+		}
+
+		node, err = w.graph.Add(ref, entry)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if node.Operation == OpCheckpoint || w.isBehind(ref) {
+		w.mu.Lock()
+		for _, pRef := range node.Parents {
+			w.behind[pRef] = true
+		}
+		w.mu.Unlock()
+	}
+	return node, nil
+}
+
+func (w *graphWalker) isBehind(ref string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.behind[ref]
+}
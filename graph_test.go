@@ -0,0 +1,236 @@
+package otlog
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGraphIndexPersist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "otlog-graph")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "graph")
+	index, err := OpenGraphIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := NewMemStore()
+	store.Index = index
+	credStore := *generateTestCredStore()
+
+	root, _ := NewEntry(nil, credStore, store)
+	root.Operation = OpBase
+	rootRef, _ := root.Save("")
+	entry, _ := NewEntry(&Link{rootRef}, credStore, store)
+	entryRef, _ := entry.Save("")
+	index.Close()
+
+	reloaded, err := OpenGraphIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reloaded.Close()
+
+	assert.Equal(t, 2, reloaded.Len())
+	node, ok := reloaded.Get(entryRef)
+	assert.True(t, ok)
+	assert.Equal(t, []string{rootRef}, node.Parents)
+	assert.Equal(t, uint64(2), node.Generation)
+	assert.Equal(t, *entry.Clock, node.clock())
+
+	//Removed nodes stay removed once reloaded
+	store.Index = reloaded
+	store.Remove(entryRef, "missing")
+	_, err = os.Stat(path + ".tmp")
+	assert.True(t, os.IsNotExist(err))
+
+	//Appends continue on the rewritten file
+	other, _ := NewEntry(&Link{rootRef}, credStore, store)
+	other.Operation = OpUpSert
+	otherRef, _ := other.Save("")
+	reloaded.Close()
+	reloaded, err = OpenGraphIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 2, reloaded.Len())
+	_, ok = reloaded.Get(entryRef)
+	assert.False(t, ok)
+	_, ok = reloaded.Get(otherRef)
+	assert.True(t, ok)
+}
+
+func TestGraphIndexTornWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "otlog-graph")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "graph")
+	index, err := OpenGraphIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewMemStore()
+	store.Index = index
+	credStore := *generateTestCredStore()
+
+	root, _ := NewEntry(nil, credStore, store)
+	root.Operation = OpBase
+	rootRef, _ := root.Save("")
+	index.Close()
+
+	//Crash part way through writing a node
+	file, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	file.WriteString(`{"r":"torn","p":[`)
+	file.Close()
+
+	index, err = OpenGraphIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, index.Len())
+	store.Index = index
+	entry, _ := NewEntry(&Link{rootRef}, credStore, store)
+	entryRef, _ := entry.Save("")
+	index.Close()
+
+	for i := 0; i < 2; i++ {
+		reloaded, err := OpenGraphIndex(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, 2, reloaded.Len())
+		_, ok := reloaded.Get(entryRef)
+		assert.True(t, ok)
+		reloaded.Close()
+	}
+}
+
+//headerStore a store without a graph index
+type headerStore struct {
+	StorageEngine
+	gets int
+}
+
+func (h *headerStore) Get(entry *Entry, ref string) (*Entry, error) {
+	h.gets++
+	return h.StorageEngine.Get(entry, ref)
+}
+
+func TestAncestorSearchFromIndex(t *testing.T) {
+	store := &countingStore{MemStore: NewMemStore()}
+	credStore := *generateTestCredStore()
+
+	root, _ := NewEntry(nil, credStore, store)
+	root.Operation = OpBase
+	rootRef, _ := root.Save("")
+
+	a, _ := NewEntry(&Link{rootRef}, credStore, store)
+	a.Save("")
+	b, _ := NewEntry(&Link{rootRef}, credStore, store)
+	b.Save("")
+
+	//Indexed on save, so no entries are fetched
+	store.gets = 0
+	lca, _, err := a.findCommonAncestor(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, rootRef, *lca)
+	assert.Equal(t, 0, store.gets)
+
+	//Without an index, headers are fetched but never decrypted
+	plain := &headerStore{StorageEngine: store}
+	for _, e := range []*Entry{a, b} {
+		e.dataStore = plain
+	}
+	lca, _, err = a.findCommonAncestor(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, rootRef, *lca)
+	assert.Equal(t, 3, plain.gets)
+}
+
+func TestSinceVisitsDiamondOnce(t *testing.T) {
+	/*
+		Test:
+			  root
+			  /  \
+			 a    b
+			  \  /
+			   c
+			   |
+			   d
+
+		since(d, root) = {a, b, c, d} with each node fetched once
+	*/
+
+	memStore := NewMemStore()
+	store := &headerStore{StorageEngine: memStore}
+	credStore := *generateTestCredStore()
+
+	root, _ := NewEntry(nil, credStore, store)
+	root.Operation = OpBase
+	rootRef, _ := root.Save("")
+	a, _ := NewEntry(&Link{rootRef}, credStore, store)
+	aRef, _ := a.Save("")
+	b, _ := NewEntry(&Link{rootRef}, credStore, store)
+	bRef, _ := b.Save("")
+	c, _ := NewEntry(&Link{aRef}, credStore, store)
+	c.Parent = append(c.Parent, &Link{bRef})
+	cRef, _ := c.Save("")
+	d, _ := NewEntry(&Link{cRef}, credStore, store)
+	dRef, _ := d.Save("")
+
+	store.gets = 0
+	refs, err := newGraphWalker(store).since([]string{dRef}, rootRef)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.ElementsMatch(t, []string{aRef, bRef, cRef, dRef}, refs)
+	assert.Equal(t, 5, store.gets)
+
+	refs, _ = newGraphWalker(store).since([]string{dRef, aRef}, "")
+	assert.Len(t, refs, 5)
+
+	refs, _ = newGraphWalker(store).since([]string{aRef}, dRef)
+	assert.Empty(t, refs)
+}
+
+func TestSinceLongChain(t *testing.T) {
+	store := NewMemStore()
+	credStore := *generateTestCredStore()
+
+	root, _ := NewEntry(nil, credStore, store)
+	root.Operation = OpBase
+	ref, _ := root.Save("")
+
+	refs := []string{ref}
+	for i := 0; i < 1000; i++ {
+		entry, _ := NewEntry(&Link{ref}, credStore, store)
+		ref, _ = entry.Save("")
+		refs = append(refs, ref)
+	}
+
+	walker := newGraphWalker(store)
+	since, err := walker.since([]string{ref}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, since, 1001)
+
+	since, _ = walker.since([]string{ref}, refs[990])
+	assert.Equal(t, refs[1000], since[0])
+	assert.Len(t, since, 10)
+}
@@ -0,0 +1,126 @@
+package otlog
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//HLC is a hybrid logical clock timestamp (physical time + logical counter + node ID)
+type HLC struct {
+	Wall    int64
+	Logical uint32
+	Node    string
+}
+
+//Compare gives -1, 0 or 1 if the timestamp is before, equal to or after o
+func (c HLC) Compare(o HLC) int {
+	switch {
+	case c.Wall < o.Wall:
+		return -1
+	case c.Wall > o.Wall:
+		return 1
+	case c.Logical < o.Logical:
+		return -1
+	case c.Logical > o.Logical:
+		return 1
+	}
+	return strings.Compare(c.Node, o.Node)
+}
+
+//Before reports whether the timestamp is ordered before o
+func (c HLC) Before(o HLC) bool {
+	return c.Compare(o) < 0
+}
+
+func (c HLC) String() string {
+	return fmt.Sprintf("%d.%d@%s", c.Wall, c.Logical, c.Node)
+}
+
+//MarshalJSON encodes the timestamp as a string, IPFS would otherwise store the wall time as a lossy float
+func (c HLC) MarshalJSON() ([]byte, error) {
+	return json.Marshal(c.String())
+}
+
+//UnmarshalJSON decodes a timestamp in the form wall.logical@node
+func (c *HLC) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return err
+	}
+
+	at := strings.IndexByte(str, '@')
+	dot := strings.IndexByte(str, '.')
+	if at < 0 || dot < 0 || dot > at {
+		return fmt.Errorf("Invalid HLC timestamp %s", str)
+	}
+
+	wall, err := strconv.ParseInt(str[:dot], 10, 64)
+	if err != nil {
+		return err
+	}
+	logical, err := strconv.ParseUint(str[dot+1:at], 10, 32)
+	if err != nil {
+		return err
+	}
+
+	*c = HLC{Wall: wall, Logical: uint32(logical), Node: str[at+1:]}
+	return nil
+}
+
+//HybridClock issues monotonic HLC timestamps for a single node
+type HybridClock struct {
+	mu   sync.Mutex
+	node string
+	last HLC
+	now  func() time.Time
+}
+
+//NewHybridClock creates a clock for the given node ID
+func NewHybridClock(node string) *HybridClock {
+	return &HybridClock{node: node, now: time.Now}
+}
+
+//Now issues a timestamp for a local event
+func (h *HybridClock) Now() HLC {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	pt := h.now().UnixNano()
+	if pt > h.last.Wall {
+		h.last = HLC{Wall: pt}
+	} else {
+		h.last.Logical++
+	}
+	h.last.Node = h.node
+
+	return h.last
+}
+
+//Update issues a timestamp for a local event which happens after the remote timestamps
+func (h *HybridClock) Update(remotes ...HLC) HLC {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	pt := h.now().UnixNano()
+	for _, remote := range remotes {
+		switch {
+		case remote.Wall > h.last.Wall:
+			h.last = HLC{Wall: remote.Wall, Logical: remote.Logical}
+		case remote.Wall == h.last.Wall && remote.Logical > h.last.Logical:
+			h.last.Logical = remote.Logical
+		}
+	}
+
+	if pt > h.last.Wall {
+		h.last = HLC{Wall: pt}
+	} else {
+		h.last.Logical++
+	}
+	h.last.Node = h.node
+
+	return h.last
+}
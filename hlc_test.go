@@ -0,0 +1,80 @@
+package otlog
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHybridClockMonotonic(t *testing.T) {
+	clock := NewHybridClock("a")
+	frozen := time.Unix(0, 100)
+	clock.now = func() time.Time { return frozen }
+
+	first := clock.Now()
+	second := clock.Now()
+	assert.True(t, first.Before(second))
+	assert.Equal(t, HLC{Wall: 100, Logical: 1, Node: "a"}, second)
+
+	//Remote clock ahead of ours
+	remote := HLC{Wall: 500, Logical: 7, Node: "b"}
+	third := clock.Update(remote)
+	assert.Equal(t, HLC{Wall: 500, Logical: 8, Node: "a"}, third)
+	assert.True(t, remote.Before(third))
+}
+
+func TestHLCJSON(t *testing.T) {
+	clock := HLC{Wall: 1553000000123456789, Logical: 3, Node: "abc"}
+
+	raw, err := json.Marshal(clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, `"1553000000123456789.3@abc"`, string(raw))
+
+	decoded := HLC{}
+	if err := json.Unmarshal(raw, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, clock, decoded)
+
+	assert.Error(t, json.Unmarshal([]byte(`"123"`), &decoded))
+}
+
+func TestSkewedClockFollowsParent(t *testing.T) {
+	/*
+		A device whose clock runs an hour behind must still order its entry after the parent
+	*/
+	memStore := NewMemStore()
+	credStore := *generateTestCredStore()
+
+	root, _ := NewEntry(nil, credStore, memStore)
+	rootRef, _ := root.Save("")
+
+	skewed := *generateTestCredStore()
+	skewed.clock.now = func() time.Time { return time.Now().Add(-1 * time.Hour) }
+
+	child, _ := NewEntry(&Link{rootRef}, skewed, memStore)
+	child.Save("")
+
+	assert.True(t, root.Clock.Before(*child.Clock))
+	assert.Equal(t, skewed.clock.node, child.Clock.Node)
+}
+
+func TestPlaybackOrderTieBreak(t *testing.T) {
+	clock := &HLC{Wall: 10, Node: "a"}
+	entries := map[string]*Entry{
+		"c": {Clock: &HLC{Wall: 5, Node: "a"}, ID: uuid.New()},
+		"b": {Clock: clock, ID: uuid.New()},
+		"a": {Clock: clock, ID: uuid.New()},
+	}
+
+	ordered := playbackOrder(entries)
+
+	assert.Equal(t, entries["c"], ordered[0])
+	assert.Equal(t, entries["a"], ordered[1])
+	assert.Equal(t, entries["b"], ordered[2])
+}
@@ -0,0 +1,131 @@
+package otlog
+
+import (
+	"fmt"
+
+	"github.com/google/uuid"
+)
+
+//PreCommitHook checks a diff before it is written, giving the diff to write or an error rejecting it
+type PreCommitHook func(diff EntryDiff) (EntryDiff, error)
+
+//PostCommitHook is called with each entry once it is saved
+type PostCommitHook func(ref string, entry *Entry)
+
+type committedEntry struct {
+	ref   string
+	entry *Entry
+}
+
+//preCommit runs the diff through the pre-commit hooks
+func (l *Log) preCommit(diff EntryDiff) (EntryDiff, error) {
+	for _, hook := range l.PreCommit {
+		var err error
+		if diff, err = hook(diff); err != nil {
+			return diff, err
+		}
+	}
+	return diff, nil
+}
+
+//checkArriving runs the diffs of the entries remoteHead would bring into the log through the
+//pre-commit hooks, giving the entries in playback order for the post-commit hooks
+func (l *Log) checkArriving(remoteHead string) ([]committedEntry, error) {
+	if len(l.PreCommit) == 0 && len(l.PostCommit) == 0 {
+		return nil, nil
+	}
+
+	refs, err := newGraphWalker(l.store).since([]string{remoteHead}, l.head)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := fetchEntries(l.store, l.credStore, refs)
+	if err != nil {
+		return nil, err
+	}
+	refOf := make(map[*Entry]string, len(entries))
+	for ref, entry := range entries {
+		refOf[entry] = ref
+	}
+
+	arriving := []committedEntry{}
+	checked := map[uuid.UUID]bool{}
+	for _, entry := range playbackOrder(entries) {
+		if entry.Operation.hasDiff() && len(l.PreCommit) > 0 {
+			diff, err := entry.DataToStruct(&EntryDiff{})
+			if err != nil {
+				return nil, err
+			}
+			if _, err := l.preCommit(*diff.(*EntryDiff)); err != nil {
+				return nil, fmt.Errorf("Entry %s rejected: %s", refOf[entry], err)
+			}
+			checked[diff.(*EntryDiff).Record.ID] = true
+		}
+		arriving = append(arriving, committedEntry{refOf[entry], entry})
+	}
+
+	if len(l.PreCommit) > 0 {
+		for _, entry := range playbackOrder(entries) {
+			if entry.Snapshot == nil || entry.Operation.hasDiff() {
+				continue
+			}
+			if err := l.checkSnapshot(entry.Snapshot.Target, checked); err != nil {
+				return nil, fmt.Errorf("Entry %s rejected: %s", refOf[entry], err)
+			}
+		}
+	}
+
+	return arriving, nil
+}
+
+//checkSnapshot runs the records of an arriving checkpoint or merge snapshot through the pre-commit
+//hooks, as upserts or deletes, the records become the log's without a diff being replayed. Records
+//already checked by their diffs or unchanged from the head are skipped
+func (l *Log) checkSnapshot(target string, checked map[uuid.UUID]bool) error {
+	snapshot, err := RecoverSnapshot(target, l.store)
+	if err != nil {
+		return err
+	}
+	records := &Records{}
+	if err := snapshot.GetRecords(l.credStore, records); err != nil {
+		return err
+	}
+	current, err := l.recordMap(l.head)
+	if err != nil {
+		return err
+	}
+
+	for _, rec := range records.Records {
+		if prior, ok := current[rec.ID]; checked[rec.ID] || (ok && recordEqual(prior, rec)) {
+			continue
+		}
+		diff := EntryDiff{Op: OpUpSert, Record: rec}
+		if rec.Deleted {
+			diff = EntryDiff{Op: OpDel, Record: Record{ID: rec.ID}}
+		}
+		if _, err := l.preCommit(diff); err != nil {
+			return err
+		}
+		checked[rec.ID] = true
+	}
+	return nil
+}
+
+//unlock releases the log then runs the post-commit hooks for the entries saved while it was held,
+//so hooks may call the log. Entries saved by a write which failed before moving the head, such as a
+//rebase failing part way, never became part of the log so are dropped
+func (l *Log) unlock(err *error) {
+	committed, hooks := l.committed, l.PostCommit
+	if *err != nil && !l.moved {
+		committed = nil
+	}
+	l.committed = nil
+	l.moved = false
+	l.mu.Unlock()
+
+	for _, c := range committed {
+		for _, hook := range hooks {
+			hook(c.ref, c.entry)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package otlog
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func requireName(diff EntryDiff) (EntryDiff, error) {
+	if diff.Op != OpUpSert {
+		return diff, nil
+	}
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal(diff.Record.Raw, &fields); err != nil || fields["name"] == nil {
+		return diff, errors.New("name is required")
+	}
+	return diff, nil
+}
+
+func TestCommitHooks(t *testing.T) {
+	log := newTestLog(t)
+	committed := []string{}
+	log.PreCommit = []PreCommitHook{
+		func(diff EntryDiff) (EntryDiff, error) {
+			if string(diff.Record.Raw) == `{}` {
+				diff.Record.Raw = json.RawMessage(`{"name":"default"}`)
+			}
+			return diff, nil
+		},
+		requireName,
+	}
+	log.PostCommit = []PostCommitHook{func(ref string, entry *Entry) {
+		//Hooks run once the log is released
+		assert.Equal(t, log.Head(), ref)
+		committed = append(committed, ref)
+	}}
+
+	head := log.Head()
+	_, err := log.Append(upsertDiff(uuid.New(), `{"age":1}`))
+	assert.Error(t, err)
+	assert.Equal(t, head, log.Head())
+	assert.Empty(t, committed)
+
+	if _, err := log.Append(upsertDiff(uuid.New(), `{}`)); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{log.Head()}, committed)
+
+	records, _ := log.Records()
+	if assert.Len(t, records, 1) {
+		assert.Equal(t, json.RawMessage(`{"name":"default"}`), records[0].Raw)
+	}
+}
+
+func TestCommitHooksOnMerge(t *testing.T) {
+	log := newTestLog(t)
+	base := log.Head()
+	log.Append(upsertDiff(uuid.New(), `{"name":"a"}`))
+
+	bad := NewLog(log.credStore, log.store, base)
+	bad.Append(upsertDiff(uuid.New(), `{"age":1}`))
+	good := NewLog(log.credStore, log.store, base)
+	good.Append(upsertDiff(uuid.New(), `{"name":"b"}`))
+	good.Append(upsertDiff(uuid.New(), `{"name":"c"}`))
+
+	committed := []string{}
+	log.PreCommit = []PreCommitHook{requireName}
+	log.PostCommit = []PostCommitHook{func(ref string, entry *Entry) {
+		committed = append(committed, ref)
+	}}
+
+	//Remote data is validated too
+	head := log.Head()
+	_, err := log.Merge(bad.Head())
+	assert.Error(t, err)
+	assert.Equal(t, head, log.Head())
+	assert.Empty(t, committed)
+
+	merge, err := log.Merge(good.Head())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, OpMerge, merge.Operation)
+	if assert.Len(t, committed, 3) {
+		assert.Equal(t, good.Head(), committed[1])
+		assert.Equal(t, log.Head(), committed[2])
+	}
+}
+
+func TestCommitHooksOnArrivingSnapshots(t *testing.T) {
+	log := newTestLog(t)
+	base := log.Head()
+	log.Append(upsertDiff(uuid.New(), `{"name":"a"}`))
+
+	log.PreCommit = []PreCommitHook{requireName}
+
+	//A checkpoint bringing a record no diff wrote
+	remote := NewLog(log.credStore, log.store, base)
+	remote.Append(upsertDiff(uuid.New(), `{"name":"b"}`))
+	forged, _ := NewEntry(&Link{remote.Head()}, log.credStore, log.store)
+	forged.Operation = OpCheckpoint
+	forged.Snapshot, _ = NewSnapshot(log.credStore, []Record{{ID: uuid.New(), Raw: []byte(`{"age":1}`)}}, log.store)
+	forgedRef, err := forged.Save("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	head := log.Head()
+	_, err = log.Merge(forgedRef)
+	assert.Error(t, err)
+	assert.Equal(t, head, log.Head())
+
+	//Checkpoints of checked history merge
+	remote.Compact()
+	if _, err := log.Merge(remote.Head()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCommitHooksDroppedOnFailedWrite(t *testing.T) {
+	log := newTestLog(t)
+	base := log.Head()
+	log.Append(upsertDiff(uuid.New(), `{"name":"a"}`))
+	log.Append(upsertDiff(uuid.New(), `{"age":1}`))
+	onto := NewLog(log.credStore, log.store, base)
+	onto.Append(upsertDiff(uuid.New(), `{"name":"b"}`))
+
+	committed := []string{}
+	log.PreCommit = []PreCommitHook{requireName}
+	log.PostCommit = []PostCommitHook{func(ref string, entry *Entry) {
+		committed = append(committed, ref)
+	}}
+
+	//The first entry is written before the second is rejected
+	head := log.Head()
+	_, err := log.Rebase(head, onto.Head())
+	assert.Error(t, err)
+	assert.Equal(t, head, log.Head())
+	assert.Empty(t, committed)
+
+	log.Append(upsertDiff(uuid.New(), `{"name":"c"}`))
+	assert.Len(t, committed, 1)
+}
@@ -0,0 +1,223 @@
+package otlog
+
+import (
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTPPushPull(t *testing.T) {
+	server := httptest.NewServer(NewHTTPHandler(NewMemStore(), NewMemRefStore()))
+	defer server.Close()
+	remote := NewHTTPStore(server.URL)
+
+	log := newTestLog(t)
+	log.Snapshots = SnapshotPolicy{EveryEntries: 2}
+	for i := 0; i < 3; i++ {
+		log.Append(upsertDiff(uuid.New(), `1`))
+	}
+
+	//Push
+	report, err := Sync(log.store, remote, []string{log.Head()}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 4, report.Entries)
+	if err := remote.CompareAndSwapRef("main", "", log.Head()); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, ErrRefConflict, remote.CompareAndSwapRef("main", "", log.Head()))
+
+	have, err := remote.HasMany([]string{log.Head(), "missing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, map[string]bool{log.Head(): true}, have)
+
+	//Pull
+	head, err := remote.GetRef("main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, log.Head(), head)
+
+	local := NewMemStore()
+	if _, err := Sync(remote, local, []string{head}, nil); err != nil {
+		t.Fatal(err)
+	}
+	replica := NewLog(log.credStore, local, head)
+	records, err := replica.Records()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, records, 3)
+	verify, _ := replica.Verify(head, nil)
+	assert.True(t, verify.OK(), "%v", verify.Problems)
+
+	//Only new entries are pushed
+	old := log.Head()
+	log.Append(upsertDiff(uuid.New(), `2`))
+	report, err = Sync(log.store, remote, []string{log.Head()}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, report.Entries)
+	if err := remote.CompareAndSwapRef("main", old, log.Head()); err != nil {
+		t.Fatal(err)
+	}
+
+	refs, err := remote.ListRefs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, map[string]string{"main": log.Head()}, refs)
+
+	has, err := remote.Has("missing")
+	assert.NoError(t, err)
+	assert.False(t, has)
+}
+
+func TestHTTPRejects(t *testing.T) {
+	log := newTestLog(t)
+	store := NewMemStore()
+	server := httptest.NewServer(&HTTPHandler{Store: store, Refs: NewMemRefStore(), Creds: &log.credStore})
+	defer server.Close()
+	remote := NewHTTPStore(server.URL)
+
+	base := log.Head()
+	log.Append(upsertDiff(uuid.New(), `1`))
+	entry, _ := log.store.Get(&Entry{}, log.Head())
+
+	//Unsigned
+	unsigned := *entry
+	unsigned.Signature = ""
+	_, err := remote.Save(&unsigned)
+	assert.Error(t, err)
+
+	//Signature of another entry
+	forged := *entry
+	root, _ := log.store.Get(&Entry{}, base)
+	forged.Signature = root.Signature
+	_, err = remote.Save(&forged)
+	assert.Error(t, err)
+
+	//Not an object
+	resp, err := http.Post(server.URL+"/objects/"+httpEntries, "application/json", strings.NewReader(`{"d":1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Empty(t, store.Entries)
+
+	//Refs can not point at history the server lacks
+	assert.Error(t, remote.CompareAndSwapRef("main", "", log.Head()))
+
+	if _, err := Sync(log.store, remote, []string{log.Head()}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.CompareAndSwapRef("main", "", base); err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.CompareAndSwapRef("main", base, log.Head()); err != nil {
+		t.Fatal(err)
+	}
+
+	//A writer still holding the old head conflicts
+	assert.Equal(t, ErrRefConflict, remote.CompareAndSwapRef("main", base, log.Head()))
+	head, _ := remote.GetRef("main")
+	assert.Equal(t, log.Head(), head)
+}
+
+func TestHTTPRefNamesWithSlashes(t *testing.T) {
+	server := httptest.NewServer(NewHTTPHandler(NewMemStore(), NewMemRefStore()))
+	defer server.Close()
+	remote := NewHTTPStore(server.URL)
+
+	log := newTestLog(t)
+	if _, err := Sync(log.store, remote, []string{log.Head()}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.CompareAndSwapRef("heads/main", "", log.Head()); err != nil {
+		t.Fatal(err)
+	}
+
+	head, err := remote.GetRef("heads/main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, log.Head(), head)
+
+	refs, _ := remote.ListRefs()
+	assert.Equal(t, map[string]string{"heads/main": log.Head()}, refs)
+}
+
+//countingHandler counts the requests made to the handler by method and path
+type countingHandler struct {
+	http.Handler
+
+	mu       sync.Mutex
+	requests map[string]int
+}
+
+func (c *countingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	key := r.Method
+	if r.URL.Path == "/have" {
+		key += " /have"
+	}
+	c.requests[key]++
+	c.mu.Unlock()
+
+	c.Handler.ServeHTTP(w, r)
+}
+
+func TestHTTPNegotiateBatches(t *testing.T) {
+	/*
+		Test:
+			   root
+			  / | \
+			 a  b  c
+
+		pushing the three heads checks each frontier with one have request
+	*/
+
+	handler := &countingHandler{Handler: NewHTTPHandler(NewMemStore(), NewMemRefStore()), requests: map[string]int{}}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	remote := NewHTTPStore(server.URL)
+
+	log := newTestLog(t)
+	root := log.Head()
+	heads := []string{}
+	for i := 0; i < 3; i++ {
+		_, ref := appendTestEntry(t, root, upsertDiff(uuid.New(), `1`), log.credStore, log.store)
+		heads = append(heads, ref)
+	}
+
+	report, err := Sync(log.store, remote, heads, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 4, report.Entries)
+	assert.Equal(t, 2, handler.requests["POST /have"])
+	assert.Zero(t, handler.requests[http.MethodHead])
+}
+
+func TestHTTPTrustRequiresCreds(t *testing.T) {
+	server := httptest.NewServer(&HTTPHandler{Store: NewMemStore(), Refs: NewMemRefStore(), Trust: x509.NewCertPool()})
+	defer server.Close()
+	remote := NewHTTPStore(server.URL)
+
+	log := newTestLog(t)
+	_, err := Sync(log.store, remote, []string{log.Head()}, nil)
+	assert.Error(t, err)
+	_, err = remote.ListRefs()
+	assert.Error(t, err)
+}
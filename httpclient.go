@@ -0,0 +1,161 @@
+package otlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+//HTTPStore is a storage engine and ref store backed by a remote HTTPHandler
+type HTTPStore struct {
+	//URL the base URL of the handler
+	URL string
+
+	//Client the HTTP client to use, defaults to http.DefaultClient
+	Client *http.Client
+}
+
+//NewHTTPStore creates a remote store for the handler at baseURL
+func NewHTTPStore(baseURL string) *HTTPStore {
+	return &HTTPStore{URL: strings.TrimRight(baseURL, "/")}
+}
+
+func (s *HTTPStore) client() *http.Client {
+	if s.Client == nil {
+		return http.DefaultClient
+	}
+	return s.Client
+}
+
+//do sends the request, decoding a JSON response into out if given
+func (s *HTTPStore) do(method, path string, body interface{}, out interface{}) (int, error) {
+	var reader io.Reader
+	if body != nil {
+		raw, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		reader = bytes.NewReader(raw)
+	}
+
+	req, err := http.NewRequest(method, s.URL+path, reader)
+	if err != nil {
+		return 0, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := s.client().Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return resp.StatusCode, fmt.Errorf("%s %s: %s %s", method, path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return resp.StatusCode, err
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+//Get fetches an entry
+func (s *HTTPStore) Get(entry *Entry, ref string) (*Entry, error) {
+	_, err := s.do(http.MethodGet, "/objects/"+httpEntries+"/"+url.PathEscape(ref), nil, entry)
+	if err != nil {
+		return nil, err
+	}
+	entry.dataStore = s
+	return entry, nil
+}
+
+//Save stores an entry, snapshot or shard remotely
+func (s *HTTPStore) Save(data interface{}) (string, error) {
+	var kind string
+	switch ty := data.(type) {
+	case *Entry:
+		kind = httpEntries
+	case *Snapshot:
+		kind = httpSnapshots
+	case *SnapshotShard:
+		kind = httpShards
+	default:
+		return "", fmt.Errorf("Unknown type %s", ty)
+	}
+
+	resp := &httpRefResponse{}
+	if _, err := s.do(http.MethodPost, "/objects/"+kind, data, resp); err != nil {
+		return "", err
+	}
+	return resp.Ref, nil
+}
+
+//GetSnapshot fetches a snapshot
+func (s *HTTPStore) GetSnapshot(ref string) (*Snapshot, error) {
+	snapshot := &Snapshot{}
+	_, err := s.do(http.MethodGet, "/objects/"+httpSnapshots+"/"+url.PathEscape(ref), nil, snapshot)
+	return snapshot, err
+}
+
+//GetShard fetches a snapshot shard
+func (s *HTTPStore) GetShard(ref string) (*SnapshotShard, error) {
+	shard := &SnapshotShard{}
+	_, err := s.do(http.MethodGet, "/objects/"+httpShards+"/"+url.PathEscape(ref), nil, shard)
+	return shard, err
+}
+
+//Has whether the remote holds the ref
+func (s *HTTPStore) Has(ref string) (bool, error) {
+	status, err := s.do(http.MethodHead, "/objects/"+url.PathEscape(ref), nil, nil)
+	if status == http.StatusNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+//HasMany the subset of refs the remote holds
+func (s *HTTPStore) HasMany(refs []string) (map[string]bool, error) {
+	resp := &httpHave{}
+	if _, err := s.do(http.MethodPost, "/have", &httpHave{Refs: refs}, resp); err != nil {
+		return nil, err
+	}
+
+	have := make(map[string]bool, len(resp.Refs))
+	for _, ref := range resp.Refs {
+		have[ref] = true
+	}
+	return have, nil
+}
+
+//ListRefs every named ref on the remote
+func (s *HTTPStore) ListRefs() (map[string]string, error) {
+	refs := map[string]string{}
+	_, err := s.do(http.MethodGet, "/refs", nil, &refs)
+	return refs, err
+}
+
+//GetRef the head of a named ref on the remote
+func (s *HTTPStore) GetRef(name string) (string, error) {
+	resp := &httpRefResponse{}
+	_, err := s.do(http.MethodGet, "/refs/"+url.PathEscape(name), nil, resp)
+	return resp.Ref, err
+}
+
+//CompareAndSwapRef moves the named ref on the remote only if it is still at old
+func (s *HTTPStore) CompareAndSwapRef(name, old, head string) error {
+	status, err := s.do(http.MethodPut, "/refs/"+url.PathEscape(name), &httpRefUpdate{Old: old, Head: head}, nil)
+	if status == http.StatusConflict {
+		return ErrRefConflict
+	}
+	return err
+}
@@ -0,0 +1,313 @@
+package otlog
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+//maxObjectSize the largest object accepted by the HTTP handler
+const maxObjectSize = 64 << 20
+
+const (
+	httpEntries   = "entries"
+	httpSnapshots = "snapshots"
+	httpShards    = "shards"
+)
+
+//httpRefUpdate the body of a compare-and-swap ref request
+type httpRefUpdate struct {
+	Old  string `json:"old"`
+	Head string `json:"head"`
+}
+
+//httpRefResponse the body of a stored object or ref
+type httpRefResponse struct {
+	Ref string `json:"ref"`
+}
+
+//httpHave the body of a have/want request and response
+type httpHave struct {
+	Refs []string `json:"refs"`
+}
+
+//HTTPHandler serves a store and its refs for replication over HTTP
+//
+//	GET  /objects/{entries|snapshots|shards}/{ref}  fetch an object
+//	HEAD /objects/{ref}                             check an object is held
+//	POST /objects/{entries|snapshots|shards}        store an object, giving its ref
+//	POST /have                                      the subset of the given refs held
+//	GET  /refs                                      every named ref
+//	GET  /refs/{name}                               a named ref
+//	PUT  /refs/{name}                               compare-and-swap a named ref
+//
+//The handler does no authentication of its own, wrap it in middleware which does before serving it
+//to anyone other than trusted writers. Entries and snapshots must carry a parsable certificate and
+//a signature, trie snapshot manifests are always validated as they are not encrypted
+type HTTPHandler struct {
+	Store StorageEngine
+	Refs  RefStore
+
+	//Trust if set, certificates of stored entries and snapshots must chain to it. Without Creds the
+	//signatures can not be checked, so the handler refuses every request when Trust is set alone
+	Trust *x509.CertPool
+
+	//Creds if set, entries and snapshots are decrypted to validate their signatures
+	Creds *CredStore
+}
+
+//NewHTTPHandler creates a replication handler for the store and refs
+func NewHTTPHandler(store StorageEngine, refs RefStore) *HTTPHandler {
+	return &HTTPHandler{Store: store, Refs: refs}
+}
+
+func (h *HTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.Trust != nil && h.Creds == nil {
+		http.Error(w, "HTTPHandler Trust requires Creds to verify signatures", http.StatusInternalServerError)
+		return
+	}
+
+	//Ref names may themselves contain slashes, everything after refs/ is the name
+	path := strings.Trim(r.URL.EscapedPath(), "/")
+	if escaped := strings.TrimPrefix(path, "refs/"); escaped != path {
+		name, err := url.PathUnescape(escaped)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		h.serveRef(w, r, name)
+		return
+	}
+
+	parts := strings.Split(path, "/")
+	switch {
+	case parts[0] == "objects" && len(parts) == 3 && r.Method == http.MethodGet:
+		h.getObject(w, parts[1], parts[2])
+	case parts[0] == "objects" && len(parts) == 2 && r.Method == http.MethodHead:
+		h.headObject(w, parts[1])
+	case parts[0] == "objects" && len(parts) == 2 && r.Method == http.MethodPost:
+		h.postObject(w, r, parts[1])
+	case parts[0] == "have" && len(parts) == 1 && r.Method == http.MethodPost:
+		h.have(w, r)
+	case parts[0] == "refs" && len(parts) == 1 && r.Method == http.MethodGet:
+		refs, err := h.Refs.ListRefs()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, refs)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (h *HTTPHandler) serveRef(w http.ResponseWriter, r *http.Request, name string) {
+	switch r.Method {
+	case http.MethodGet:
+		head, err := h.Refs.GetRef(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, &httpRefResponse{Ref: head})
+	case http.MethodPut:
+		h.putRef(w, r, name)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (h *HTTPHandler) getObject(w http.ResponseWriter, kind, ref string) {
+	var obj interface{}
+	var err error
+	switch kind {
+	case httpEntries:
+		obj, err = h.Store.Get(&Entry{dataStore: h.Store, isEncrypted: true}, ref)
+	case httpSnapshots:
+		obj, err = h.Store.GetSnapshot(ref)
+	case httpShards:
+		obj, err = h.Store.GetShard(ref)
+	default:
+		http.Error(w, "Unknown object type", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, obj)
+}
+
+func (h *HTTPHandler) headObject(w http.ResponseWriter, ref string) {
+	has, err := h.has(ref)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !has {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *HTTPHandler) has(ref string) (bool, error) {
+	for _, kind := range []objectKind{objectEntry, objectSnapshot, objectShard} {
+		has, err := storeHas(h.Store, ref, kind)
+		if err != nil || has {
+			return has, err
+		}
+	}
+	return false, nil
+}
+
+func (h *HTTPHandler) postObject(w http.ResponseWriter, r *http.Request, kind string) {
+	var obj interface{}
+	switch kind {
+	case httpEntries:
+		obj = &Entry{}
+	case httpSnapshots:
+		obj = &Snapshot{}
+	case httpShards:
+		obj = &SnapshotShard{}
+	default:
+		http.Error(w, "Unknown object type", http.StatusNotFound)
+		return
+	}
+
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxObjectSize)).Decode(obj); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := h.validate(obj); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ref, err := h.Store.Save(obj)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if entry, ok := obj.(*Entry); ok {
+		if graph := storeGraph(h.Store); graph != nil {
+			if _, err := graph.Add(ref, entry); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	writeJSON(w, &httpRefResponse{Ref: ref})
+}
+
+//validate checks what can be of an object before it is stored
+func (h *HTTPHandler) validate(obj interface{}) error {
+	switch o := obj.(type) {
+	case *Entry:
+		if err := h.validateCert(o.PublicCert, o.Signature); err != nil {
+			return err
+		}
+		if _, err := base64.StdEncoding.DecodeString(o.Data); err != nil {
+			return fmt.Errorf("Entry data is not encrypted: %s", err)
+		}
+		if h.Creds != nil {
+			decrypted := *o
+			decrypted.credStore = *h.Creds
+			decrypted.isEncrypted = true
+			if err := decrypted.DecryptData(); err != nil {
+				return err
+			}
+			return verifyOperation(&decrypted)
+		}
+	case *Snapshot:
+		if err := h.validateCert(o.PubCert, o.Signature); err != nil {
+			return err
+		}
+		if o.Root != nil || o.Records == "" {
+			return o.validateManifest()
+		}
+		if h.Creds != nil {
+			return o.GetRecords(*h.Creds, &json.RawMessage{})
+		}
+	}
+	return nil
+}
+
+func (h *HTTPHandler) validateCert(cert, signature string) error {
+	if signature == "" {
+		return errors.New("Object is not signed")
+	}
+	if h.Trust != nil {
+		return verifyTrust(cert, h.Trust)
+	}
+	decoded, err := base64.StdEncoding.DecodeString(cert)
+	if err != nil {
+		return err
+	}
+	_, err = x509.ParseCertificate(decoded)
+	return err
+}
+
+func (h *HTTPHandler) have(w http.ResponseWriter, r *http.Request) {
+	req := &httpHave{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxObjectSize)).Decode(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resp := &httpHave{Refs: []string{}}
+	for _, ref := range req.Refs {
+		has, err := h.has(ref)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if has {
+			resp.Refs = append(resp.Refs, ref)
+		}
+	}
+	writeJSON(w, resp)
+}
+
+func (h *HTTPHandler) putRef(w http.ResponseWriter, r *http.Request, name string) {
+	req := &httpRefUpdate{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxObjectSize)).Decode(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	//Refs only ever point at history held here, push objects before the ref
+	if req.Head != "" {
+		has, err := storeHas(h.Store, req.Head, objectEntry)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		} else if !has {
+			http.Error(w, "Head is not held, push its objects first", http.StatusUnprocessableEntity)
+			return
+		}
+	}
+
+	err := h.Refs.CompareAndSwapRef(name, req.Old, req.Head)
+	if err == ErrRefConflict {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, &httpRefResponse{Ref: req.Head})
+}
+
+func writeJSON(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(data)
+}
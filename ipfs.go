@@ -1,7 +1,10 @@
 package otlog
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"strings"
 
 	shell "github.com/ipfs/go-ipfs-shell"
 )
@@ -9,6 +12,26 @@ import (
 //IpfsStore uses IPFS to save/get entries
 type IpfsStore struct {
 	Shell *shell.Shell
+
+	//Index optionally caches the commit-graph of entries seen, see OpenGraphIndex to persist it locally
+	Index *GraphIndex
+
+	//Pins tracks the objects the store pinned, which garbage collection is limited to. See OpenPinSet
+	//to persist it locally
+	Pins *PinSet
+
+	//Workers the number of entries fetched at once during walks, defaults to DefaultFetchWorkers
+	Workers int
+}
+
+//FetchWorkers the number of entries which may be fetched at once
+func (ipfs *IpfsStore) FetchWorkers() int {
+	return ipfs.Workers
+}
+
+//Graph the commit-graph index of entries seen
+func (ipfs *IpfsStore) Graph() *GraphIndex {
+	return ipfs.Index
 }
 
 //Get from IPFS as Dag
@@ -24,7 +47,21 @@ func (ipfs *IpfsStore) Save(data interface{}) (string, error) {
 		return "", err
 	}
 
-	return ipfs.Shell.DagPut(bytes, "json", "cbor")
+	ref, err := ipfs.Shell.DagPut(bytes, "json", "cbor")
+	if err != nil {
+		return "", err
+	}
+
+	//Pinned directly, each object is kept or collected on its own rather than with everything it links to
+	if err := ipfs.Shell.Request("pin/add", ref).Option("recursive", false).Exec(context.Background(), nil); err != nil {
+		return "", err
+	}
+	if ipfs.Pins != nil {
+		if err := ipfs.Pins.Add(ref); err != nil {
+			return "", err
+		}
+	}
+	return ref, nil
 }
 
 //GetSnapshot fetches a snapshot from storage
@@ -34,3 +71,62 @@ func (ipfs *IpfsStore) GetSnapshot(ref string) (*Snapshot, error) {
 
 	return snap, err
 }
+
+//GetShard fetches a snapshot shard from storage
+func (ipfs *IpfsStore) GetShard(ref string) (*SnapshotShard, error) {
+	shard := &SnapshotShard{}
+	err := ipfs.Shell.DagGet(ref, shard)
+
+	return shard, err
+}
+
+//Refs the objects the store pinned, other pins on the node are never listed
+func (ipfs *IpfsStore) Refs() ([]string, error) {
+	if ipfs.Pins == nil {
+		return nil, errors.New("IpfsStore has no pin set, the objects it pinned are unknown")
+	}
+	return ipfs.Pins.Refs(), nil
+}
+
+//Remove unpins the refs the store pinned so the IPFS node can reclaim them
+func (ipfs *IpfsStore) Remove(refs ...string) error {
+	if ipfs.Pins == nil {
+		return errors.New("IpfsStore has no pin set, the objects it pinned are unknown")
+	}
+
+	unpinned := []string{}
+	for _, ref := range refs {
+		if !ipfs.Pins.Has(ref) {
+			continue
+		}
+		if err := ipfs.Shell.Request("pin/rm", ref).Option("recursive", false).Exec(context.Background(), nil); err != nil {
+			return err
+		}
+		unpinned = append(unpinned, ref)
+	}
+	if err := ipfs.Pins.Remove(unpinned...); err != nil {
+		return err
+	}
+	if ipfs.Index != nil {
+		return ipfs.Index.Remove(unpinned...)
+	}
+	return nil
+}
+
+//Has whether the IPFS node holds the ref locally, the network is not searched for it
+func (ipfs *IpfsStore) Has(ref string) (bool, error) {
+	stat := &struct{ Key string }{}
+	err := ipfs.Shell.Request("block/stat", ref).Option("offline", true).Exec(context.Background(), stat)
+	if err == nil {
+		return true, nil
+	}
+	if serr, ok := err.(*shell.Error); ok && strings.Contains(serr.Message, "not found") {
+		return false, nil
+	}
+	return false, err
+}
+
+//GetBlock the raw DAG-CBOR block of the ref
+func (ipfs *IpfsStore) GetBlock(ref string) ([]byte, error) {
+	return ipfs.Shell.BlockGet(ref)
+}
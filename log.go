@@ -0,0 +1,704 @@
+package otlog
+
+import (
+	"container/heap"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+//ConflictResolver decides what to write when a replayed diff touches a record which was also changed
+//on the target, current is the targets version of the record. Returning false drops the diff
+type ConflictResolver func(current Record, diff EntryDiff) (EntryDiff, bool, error)
+
+//ReplayWins keeps the replayed diff, the default when no resolver is set
+func ReplayWins(current Record, diff EntryDiff) (EntryDiff, bool, error) {
+	return diff, true, nil
+}
+
+//TargetWins drops replayed diffs for records changed on the target
+func TargetWins(current Record, diff EntryDiff) (EntryDiff, bool, error) {
+	return diff, false, nil
+}
+
+//SnapshotPolicy decides when a snapshot is attached to an entry being written, so readers find one
+//within a bounded distance of any head. Zero values disable each trigger
+type SnapshotPolicy struct {
+	//EveryEntries snapshot once this many entries were written since the last snapshot
+	EveryEntries int
+
+	//EveryBytes snapshot once the diffs written since the last snapshot reach this size
+	EveryBytes int
+
+	//Interval snapshot once this long has passed since the last snapshot
+	Interval time.Duration
+}
+
+//snapshotState tracks the writes since the last snapshot of the chain ending at head
+type snapshotState struct {
+	head    string
+	entries int
+	bytes   int
+	at      time.Time
+}
+
+//Log tracks the head of an entry chain and writes new entries on top of it
+type Log struct {
+	mu        sync.Mutex
+	credStore CredStore
+	store     StorageEngine
+	head      string
+	snapshots *snapshotState
+	subs      map[*Subscription]bool
+	watched   *watchState
+	committed []committedEntry
+
+	//moved whether the head moved while the log was locked, see unlock
+	moved bool
+
+	//Resolver handles conflicts when replaying diffs, defaults to ReplayWins
+	Resolver ConflictResolver
+
+	//Snapshots the policy for attaching snapshots to written entries
+	Snapshots SnapshotPolicy
+
+	//PreCommit hooks run in order on each diff before it is written, each may change the diff or
+	//reject it by returning an error. They also check the diffs of entries arriving by merge, and the
+	//records of arriving snapshots, which are signed by their writer so can only be rejected. They run with the log locked so must not call it
+	PreCommit []PreCommitHook
+
+	//PostCommit hooks run in order with each entry once saved, including entries arriving by merge
+	PostCommit []PostCommitHook
+
+	//Broadcaster announces the head after each write when set, see Follow. A write still stands when
+	//announcing fails, the error is returned along with the entry
+	Broadcaster HeadBroadcaster
+}
+
+//NewLog opens a log at the given head, an empty head starts a new chain
+func NewLog(credStore CredStore, store StorageEngine, head string) *Log {
+	return &Log{credStore: credStore, store: store, head: head}
+}
+
+//Head the ref of the latest entry
+func (l *Log) Head() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.head
+}
+
+//Append writes a diff as a new entry on top of the head
+func (l *Log) Append(diff EntryDiff) (_ *Entry, err error) {
+	l.mu.Lock()
+	defer l.unlock(&err)
+
+	diff, err = l.preCommit(diff)
+	if err != nil {
+		return nil, err
+	}
+	entry, ref, err := l.write(l.head, diff)
+	if err != nil {
+		return nil, err
+	}
+	return entry, l.moveHead(ref)
+}
+
+//Records the record set as of the head
+func (l *Log) Records() ([]Record, error) {
+	head := l.Head()
+	if head == "" {
+		return []Record{}, nil
+	}
+
+	records, err := l.view().recordsAt(head)
+	if err != nil {
+		return nil, err
+	}
+	return records.Records, nil
+}
+
+//Rebase replays the entries of the branch since it forked from onto as new entries on top of onto,
+//giving the new branch head. The log head follows if it was the branch head
+func (l *Log) Rebase(branchHead, onto string) (_ *Entry, err error) {
+	l.mu.Lock()
+	defer l.unlock(&err)
+
+	view := l.view()
+	walker := newGraphWalker(l.store)
+	base, _, err := walker.lowestCommonAncestor(branchHead, onto)
+	if err != nil {
+		return nil, err
+	}
+	if base == nil {
+		return nil, errors.New("no common ancestor")
+	}
+
+	//Already on top of onto, or nothing to replay
+	if *base == onto || *base == branchHead {
+		head := branchHead
+		if *base == branchHead {
+			head = onto
+		}
+		if l.head == branchHead {
+			if err := l.moveHead(head); err != nil {
+				return nil, err
+			}
+		}
+		return NewEntryFromStorage(l.store, l.credStore, head)
+	}
+
+	branch, err := l.diffsSince(walker, branchHead, *base)
+	if err != nil {
+		return nil, err
+	}
+	target, err := l.diffsSince(walker, onto, *base)
+	if err != nil {
+		return nil, err
+	}
+	changed := map[string]bool{}
+	for _, diff := range target {
+		changed[diff.Record.ID.String()] = true
+	}
+
+	records, err := view.recordsAt(onto)
+	if err != nil {
+		return nil, err
+	}
+	current := records.Records
+
+	head := onto
+	var entry *Entry
+	for _, diff := range branch {
+		if diff.Op != OpCRDT && changed[diff.Record.ID.String()] {
+			var keep bool
+			diff, keep, err = l.resolve(current, diff)
+			if err != nil {
+				return nil, err
+			}
+			if !keep {
+				continue
+			}
+		}
+
+		if diff, err = l.preCommit(diff); err != nil {
+			return nil, err
+		}
+		entry, head, err = l.write(head, diff)
+		if err != nil {
+			return nil, err
+		}
+		current, err = view.applyDiff(diff, entry.clock(), entry.parentRefs(), current)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if entry == nil {
+		entry, err = NewEntryFromStorage(l.store, l.credStore, head)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if l.head == branchHead {
+		return entry, l.moveHead(head)
+	}
+	return entry, nil
+}
+
+//Merge merges the history of remoteHead into the log, which must already be in its store. Heads the log
+//contains are left alone and heads containing the log are fast-forwarded to, otherwise a merge entry
+//is written. The resulting head entry is given
+func (l *Log) Merge(remoteHead string) (*Entry, error) {
+	return l.merge(remoteHead, true)
+}
+
+func (l *Log) merge(remoteHead string, announce bool) (_ *Entry, err error) {
+	l.mu.Lock()
+	defer l.unlock(&err)
+
+	var contained, merged bool
+	if l.head != "" {
+		base, _, err := newGraphWalker(l.store).lowestCommonAncestor(l.head, remoteHead)
+		if err != nil {
+			return nil, err
+		}
+		if base == nil {
+			return nil, errors.New("no common ancestor")
+		}
+		contained, merged = *base == remoteHead, *base != remoteHead && *base != l.head
+	}
+
+	head := remoteHead
+	var entry *Entry
+	var arriving []committedEntry
+	if contained {
+		head = l.head
+	} else {
+		var err error
+		if arriving, err = l.checkArriving(remoteHead); err != nil {
+			return nil, err
+		}
+	}
+
+	if merged {
+		local, err := NewEntryFromStorage(l.store, l.credStore, l.head)
+		if err != nil {
+			return nil, err
+		}
+		remote, err := NewEntryFromStorage(l.store, l.credStore, remoteHead)
+		if err != nil {
+			return nil, err
+		}
+		if entry, _, err = local.Merge(remote); err != nil {
+			return nil, err
+		}
+		if head, err = entry.Save(""); err != nil {
+			return nil, err
+		}
+		arriving = append(arriving, committedEntry{head, entry})
+		l.snapshots = &snapshotState{head: head, at: entry.Time}
+	}
+	l.committed = append(l.committed, arriving...)
+
+	if entry == nil {
+		var err error
+		if entry, err = NewEntryFromStorage(l.store, l.credStore, head); err != nil {
+			return nil, err
+		}
+	}
+	if !announce {
+		l.setHead(head)
+		return entry, nil
+	}
+	return entry, l.moveHead(head)
+}
+
+//Revert appends a new entry undoing the change made by the entry at ref, restoring the
+//record as it was before the entry or deleting it if the entry inserted it
+func (l *Log) Revert(ref string) (_ *Entry, err error) {
+	l.mu.Lock()
+	defer l.unlock(&err)
+
+	entry, diff, err := l.entryDiff(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	prior := Record{ID: diff.Record.ID}
+	existed := false
+	if len(entry.Parent) > 0 && entry.Parent[0] != nil {
+		records, err := l.view().recordsAt(entry.Parent[0].Target)
+		if err != nil {
+			return nil, err
+		}
+		for _, rec := range records.Records {
+			if rec.ID == diff.Record.ID {
+				prior = rec
+				existed = !rec.Deleted
+				break
+			}
+		}
+	}
+
+	inverse, err := inverseDiff(diff, prior, existed)
+	if err != nil {
+		return nil, err
+	}
+	if inverse, err = l.preCommit(inverse); err != nil {
+		return nil, err
+	}
+
+	revert, head, err := l.write(l.head, inverse)
+	if err != nil {
+		return nil, err
+	}
+	return revert, l.moveHead(head)
+}
+
+//CherryPick appends the diff of the entry at ref, usually from another branch, on top of the head
+func (l *Log) CherryPick(ref string) (_ *Entry, err error) {
+	l.mu.Lock()
+	defer l.unlock(&err)
+
+	_, diff, err := l.entryDiff(ref)
+	if err != nil {
+		return nil, err
+	}
+	if diff, err = l.preCommit(diff); err != nil {
+		return nil, err
+	}
+
+	entry, head, err := l.write(l.head, diff)
+	if err != nil {
+		return nil, err
+	}
+	return entry, l.moveHead(head)
+}
+
+//Compact writes a checkpoint entry holding a snapshot of the full record set on top of the head,
+//readers starting at or after it never need the history before it
+func (l *Log) Compact() (_ *Entry, err error) {
+	l.mu.Lock()
+	defer l.unlock(&err)
+
+	if l.head == "" {
+		return nil, errors.New("Nothing to compact")
+	}
+
+	records, err := l.view().recordsAt(l.head)
+	if err != nil {
+		return nil, err
+	}
+	records.store = l.store
+
+	entry, err := NewEntry(&Link{l.head}, l.credStore, l.store)
+	if err != nil {
+		return nil, err
+	}
+	entry.Operation = OpCheckpoint
+	entry.Snapshot, err = records.Snapshot(l.credStore)
+	if err != nil {
+		return nil, err
+	}
+
+	ref, err := entry.Save("")
+	if err != nil {
+		return nil, err
+	}
+	l.committed = append(l.committed, committedEntry{ref, entry})
+	l.snapshots = &snapshotState{head: ref, at: entry.Time}
+	return entry, l.moveHead(ref)
+}
+
+//Prunable the refs behind the latest checkpoint on the head which the head no longer needs,
+//these can be dropped from local storage
+func (l *Log) Prunable() ([]string, error) {
+	head := l.Head()
+	if head == "" {
+		return []string{}, nil
+	}
+
+	walker := newGraphWalker(l.store)
+	checkpoint, err := l.latestCheckpoint(walker, head)
+	if err != nil || checkpoint == nil {
+		return []string{}, err
+	}
+
+	needed, err := walker.since([]string{head}, checkpoint.Ref)
+	if err != nil {
+		return nil, err
+	}
+	keep := map[string]bool{checkpoint.Ref: true}
+	for _, ref := range needed {
+		keep[ref] = true
+	}
+
+	behind, err := walker.since(checkpoint.Parents, "")
+	if err != nil {
+		return nil, err
+	}
+	prunable := []string{}
+	for _, ref := range behind {
+		if !keep[ref] {
+			prunable = append(prunable, ref)
+		}
+	}
+	return prunable, nil
+}
+
+//latestCheckpoint the checkpoint closest to head, nil if there is none
+func (l *Log) latestCheckpoint(walker *graphWalker, head string) (*GraphNode, error) {
+	visited := map[string]bool{head: true}
+	queue := &generationQueue{}
+	node, err := walker.node(head)
+	if err != nil {
+		return nil, err
+	}
+	heap.Push(queue, generationItem{head, node.Generation})
+
+	for queue.Len() > 0 {
+		node, err := walker.node(heap.Pop(queue).(generationItem).ref)
+		if err != nil {
+			return nil, err
+		}
+		if node.Operation == OpCheckpoint {
+			return node, nil
+		}
+		for _, pRef := range node.Parents {
+			if visited[pRef] {
+				continue
+			}
+			visited[pRef] = true
+			pNode, err := walker.node(pRef)
+			if err != nil {
+				return nil, err
+			}
+			heap.Push(queue, generationItem{pRef, pNode.Generation})
+		}
+	}
+	return nil, nil
+}
+
+//entryDiff loads the entry at ref and its diff, merge and base entries carry no diff
+func (l *Log) entryDiff(ref string) (*Entry, EntryDiff, error) {
+	entry, err := NewEntryFromStorage(l.store, l.credStore, ref)
+	if err != nil {
+		return nil, EntryDiff{}, err
+	}
+	if !entry.Operation.hasDiff() {
+		return nil, EntryDiff{}, fmt.Errorf("%s entries have no diff", entry.Operation)
+	}
+
+	diff, err := entry.DataToStruct(&EntryDiff{})
+	if err != nil {
+		return nil, EntryDiff{}, err
+	}
+	return entry, *diff.(*EntryDiff), nil
+}
+
+//inverseDiff the diff undoing diff, given the record before it was applied
+func inverseDiff(diff EntryDiff, prior Record, existed bool) (EntryDiff, error) {
+	switch diff.Op {
+	case OpUpSert:
+		if !existed {
+			return EntryDiff{Op: OpDel, Record: Record{ID: diff.Record.ID}}, nil
+		}
+		//Only the raw data is restored, CRDT fields keep changes made since
+		prior.Fields = nil
+		return EntryDiff{Op: OpUpSert, Record: prior}, nil
+	case OpDel:
+		if !existed {
+			return EntryDiff{}, errors.New("Record did not exist before delete")
+		}
+		return EntryDiff{Op: OpUpSert, Record: prior}, nil
+	case OpCRDT:
+		ops := make([]FieldOp, 0, len(diff.Fields))
+		for _, op := range diff.Fields {
+			inverse, err := inverseFieldOp(op, prior.field(op.Field))
+			if err != nil {
+				return EntryDiff{}, err
+			}
+			ops = append(ops, inverse...)
+		}
+		return EntryDiff{Op: OpCRDT, Record: Record{ID: diff.Record.ID}, Fields: ops}, nil
+	}
+	return EntryDiff{}, fmt.Errorf("Unknown operation %s", diff.Op)
+}
+
+//inverseFieldOp the operations undoing op, given the field before it was applied
+func inverseFieldOp(op FieldOp, prior *Field) ([]FieldOp, error) {
+	switch op.Type {
+	case CRDTCounter:
+		return []FieldOp{NewCounterOp(op.Field, -op.Delta)}, nil
+	case CRDTSet, CRDTMultiValue:
+		inverse := FieldOp{Type: op.Type, Field: op.Field}
+		if op.Tag != "" && op.Value != nil {
+			inverse.Remove = []string{op.Tag}
+		}
+		ops := []FieldOp{inverse}
+		//Removed values are re-added as new observations
+		for _, tag := range op.Remove {
+			if prior == nil || prior.Entries[tag] == nil {
+				continue
+			}
+			ops = append(ops, FieldOp{Type: op.Type, Field: op.Field, Value: prior.Entries[tag], Tag: uuid.New().String()})
+		}
+		return ops, nil
+	case CRDTRegister:
+		value := json.RawMessage("null")
+		if prior != nil && prior.Value != nil {
+			value = prior.Value
+		}
+		return []FieldOp{{Type: CRDTRegister, Field: op.Field, Value: value, Tag: uuid.New().String()}}, nil
+	}
+	return nil, fmt.Errorf("Unknown CRDT type %s", op.Type)
+}
+
+//diffsSince the diffs written since base in playback order
+func (l *Log) diffsSince(walker *graphWalker, head, base string) ([]EntryDiff, error) {
+	refs, err := walker.since([]string{head}, base)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := fetchEntries(l.store, l.credStore, refs)
+	if err != nil {
+		return nil, err
+	}
+
+	diffs := []EntryDiff{}
+	for _, entry := range playbackOrder(entries) {
+		if !entry.Operation.hasDiff() {
+			continue
+		}
+		diff, err := entry.DataToStruct(&EntryDiff{})
+		if err != nil {
+			return nil, err
+		}
+		diffs = append(diffs, *diff.(*EntryDiff))
+	}
+	return diffs, nil
+}
+
+func (l *Log) resolve(current []Record, diff EntryDiff) (EntryDiff, bool, error) {
+	resolver := l.Resolver
+	if resolver == nil {
+		resolver = ReplayWins
+	}
+
+	rec := Record{ID: diff.Record.ID}
+	for _, r := range current {
+		if r.ID == diff.Record.ID {
+			rec = r
+			break
+		}
+	}
+	return resolver(rec, diff)
+}
+
+//write saves the diff as a new entry on top of parent
+func (l *Log) write(parent string, diff EntryDiff) (*Entry, string, error) {
+	var link *Link
+	if parent != "" {
+		link = &Link{parent}
+	}
+
+	entry, err := NewEntry(link, l.credStore, l.store)
+	if err != nil {
+		return nil, "", err
+	}
+	entry.Operation = diff.Op
+
+	data, err := json.Marshal(diff)
+	if err != nil {
+		return nil, "", err
+	}
+
+	snapshot, err := l.snapshotDue(parent, diff.Op, len(data))
+	if err != nil {
+		return nil, "", err
+	}
+	if snapshot {
+		if err := l.attachSnapshot(entry, parent, diff); err != nil {
+			return nil, "", err
+		}
+	}
+
+	if err := entry.Encrypt(string(data)); err != nil {
+		return nil, "", err
+	}
+
+	ref, err := entry.Save("")
+	if err != nil {
+		return nil, "", err
+	}
+	l.committed = append(l.committed, committedEntry{ref, entry})
+
+	if snapshot {
+		l.snapshots = &snapshotState{head: ref, at: entry.Time}
+	} else if l.snapshots != nil {
+		l.snapshots = &snapshotState{head: ref, entries: l.snapshots.entries + 1, bytes: l.snapshots.bytes + len(data), at: l.snapshots.at}
+	}
+	return entry, ref, nil
+}
+
+//snapshotDue checks the snapshot policy for a diff of the given size written on top of parent
+func (l *Log) snapshotDue(parent string, op Operation, size int) (bool, error) {
+	policy := l.Snapshots
+	if op == OpBase || (policy.EveryEntries <= 0 && policy.EveryBytes <= 0 && policy.Interval <= 0) {
+		return false, nil
+	}
+
+	if l.snapshots == nil || l.snapshots.head != parent {
+		state, err := l.snapshotStateAt(parent)
+		if err != nil {
+			return false, err
+		}
+		l.snapshots = state
+	}
+	state := l.snapshots
+
+	return (policy.EveryEntries > 0 && state.entries+1 >= policy.EveryEntries) ||
+		(policy.EveryBytes > 0 && state.bytes+size >= policy.EveryBytes) ||
+		(policy.Interval > 0 && time.Since(state.at) >= policy.Interval), nil
+}
+
+//snapshotStateAt counts the writes since the nearest snapshot on the chain ending at head
+func (l *Log) snapshotStateAt(head string) (*snapshotState, error) {
+	state := &snapshotState{head: head, at: time.Now()}
+	if head == "" {
+		return state, nil
+	}
+
+	walker := newGraphWalker(l.store)
+	snapshotRef, _, err := walker.nearestSnapshot(head)
+	if err != nil {
+		return nil, err
+	}
+	if snapshotRef != "" {
+		node, err := walker.node(snapshotRef)
+		if err != nil {
+			return nil, err
+		}
+		state.at = node.Time
+	}
+
+	refs, err := walker.since([]string{head}, snapshotRef)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := fetchEntries(l.store, l.credStore, refs)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		state.entries++
+		state.bytes += len(entry.Data)
+		//Without a snapshot the chain is timed from its root
+		if snapshotRef == "" && entry.Time.Before(state.at) {
+			state.at = entry.Time
+		}
+	}
+	return state, nil
+}
+
+//attachSnapshot snapshots the records as they will be once the diff is applied on top of parent
+func (l *Log) attachSnapshot(entry *Entry, parent string, diff EntryDiff) error {
+	records := &Records{Records: []Record{}}
+	if parent != "" {
+		var err error
+		records, err = l.view().recordsAt(parent)
+		if err != nil {
+			return err
+		}
+	}
+
+	//The clock is needed up front to apply field operations as the entry will
+	if err := entry.stamp(); err != nil {
+		return err
+	}
+	if diff.Op != OpMerge {
+		var err error
+		records.Records, err = l.view().applyDiff(diff, entry.clock(), entry.parentRefs(), records.Records)
+		if err != nil {
+			return err
+		}
+	}
+
+	records.store = l.store
+	link, err := records.Snapshot(l.credStore)
+	if err != nil {
+		return err
+	}
+	entry.Snapshot = link
+	return nil
+}
+
+//view an entry bound to the logs stores, for replaying history
+func (l *Log) view() *Entry {
+	return &Entry{credStore: l.credStore, dataStore: l.store}
+}
@@ -0,0 +1,348 @@
+package otlog
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestLog(t *testing.T) *Log {
+	log := NewLog(*generateTestCredStore(), NewMemStore(), "")
+	if _, err := log.Append(EntryDiff{Op: OpBase}); err != nil {
+		t.Fatal(err)
+	}
+	return log
+}
+
+func upsertDiff(id uuid.UUID, data string) EntryDiff {
+	return EntryDiff{Op: OpUpSert, Record: Record{ID: id, Raw: json.RawMessage(data)}}
+}
+
+func TestRebase(t *testing.T) {
+	/*
+		Test:
+			   root
+			    /\
+			   /  \
+			 b1    o1
+			 |
+			 b2
+
+		rebasing b2 onto o1 gives root - o1 - b1' - b2'
+	*/
+
+	rec1, rec2 := uuid.New(), uuid.New()
+
+	for _, tc := range []struct {
+		resolver ConflictResolver
+		rec1     string
+	}{
+		{nil, `"branch"`},
+		{TargetWins, `"onto"`},
+	} {
+		log := newTestLog(t)
+		rootRef := log.Head()
+
+		log.Append(upsertDiff(rec1, `"branch"`))
+		log.Append(upsertDiff(rec2, `"branch"`))
+		branchHead := log.Head()
+
+		onto := NewLog(log.credStore, log.store, rootRef)
+		onto.Append(upsertDiff(rec1, `"onto"`))
+
+		log.Resolver = tc.resolver
+		head, err := log.Rebase(branchHead, onto.Head())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		headRef, _ := head.Save("")
+		assert.Equal(t, headRef, log.Head())
+
+		//Linear history on top of onto
+		for ref := headRef; ref != onto.Head(); {
+			node, err := newGraphWalker(log.store).node(ref)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Len(t, node.Parents, 1)
+			ref = node.Parents[0]
+		}
+
+		records, err := log.Records()
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Len(t, records, 2)
+		for _, rec := range records {
+			if rec.ID == rec1 {
+				assert.Equal(t, tc.rec1, string(rec.Raw))
+			} else {
+				assert.Equal(t, `"branch"`, string(rec.Raw))
+			}
+		}
+	}
+}
+
+func TestRebaseFastForward(t *testing.T) {
+	log := newTestLog(t)
+	rootRef := log.Head()
+	log.Append(upsertDiff(uuid.New(), `1`))
+	onto := log.Head()
+
+	log.head = rootRef
+	entry, err := log.Rebase(rootRef, onto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, _ := entry.Save("")
+	assert.Equal(t, onto, ref)
+	assert.Equal(t, onto, log.Head())
+}
+
+func TestRevert(t *testing.T) {
+	log := newTestLog(t)
+	rootRef := log.Head()
+	rec1, rec2 := uuid.New(), uuid.New()
+
+	log.Append(upsertDiff(rec1, `"v1"`))
+	update, _ := log.Append(upsertDiff(rec1, `"v2"`))
+	updateRef, _ := update.Save("")
+	insert, _ := log.Append(upsertDiff(rec2, `"v1"`))
+	insertRef, _ := insert.Save("")
+	add, _ := NewSetAddOp("tags", "a")
+	crdt, _ := log.Append(EntryDiff{Op: OpCRDT, Record: Record{ID: rec1}, Fields: []FieldOp{NewCounterOp("n", 4), add}})
+	crdtRef, _ := crdt.Save("")
+
+	for _, ref := range []string{updateRef, insertRef, crdtRef} {
+		if _, err := log.Revert(ref); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	records, err := log.Records()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, records, 2)
+	for _, rec := range records {
+		if rec.ID == rec1 {
+			assert.Equal(t, `"v1"`, string(rec.Raw))
+			assert.Equal(t, int64(0), rec.Counter("n"))
+			assert.Empty(t, rec.SetMembers("tags"))
+		} else {
+			assert.True(t, rec.Deleted)
+		}
+	}
+
+	_, err = log.Revert(rootRef)
+	assert.Error(t, err)
+}
+
+func TestRevertKeepsLaterFieldChanges(t *testing.T) {
+	log := newTestLog(t)
+	rec := uuid.New()
+
+	log.Append(EntryDiff{Op: OpCRDT, Record: Record{ID: rec}, Fields: []FieldOp{NewCounterOp("n", 1)}})
+	upsert, _ := log.Append(upsertDiff(rec, `"b"`))
+	upsertRef, _ := upsert.Save("")
+	log.Append(EntryDiff{Op: OpCRDT, Record: Record{ID: rec}, Fields: []FieldOp{NewCounterOp("n", 5)}})
+
+	if _, err := log.Revert(upsertRef); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := log.Records()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.Len(t, records, 1) {
+		assert.Empty(t, records[0].Raw)
+		assert.Equal(t, int64(6), records[0].Counter("n"))
+	}
+}
+
+func TestCherryPick(t *testing.T) {
+	log := newTestLog(t)
+	rootRef := log.Head()
+	rec1 := uuid.New()
+
+	other := NewLog(log.credStore, log.store, rootRef)
+	other.Append(upsertDiff(uuid.New(), `"skip"`))
+	pick, _ := other.Append(upsertDiff(rec1, `"picked"`))
+	pickRef, _ := pick.Save("")
+
+	if _, err := log.CherryPick(pickRef); err != nil {
+		t.Fatal(err)
+	}
+
+	records, _ := log.Records()
+	assert.Len(t, records, 1)
+	assert.Equal(t, rec1, records[0].ID)
+	assert.Equal(t, `"picked"`, string(records[0].Raw))
+
+	_, err := log.CherryPick(rootRef)
+	assert.Error(t, err)
+}
+
+func TestSnapshotPolicy(t *testing.T) {
+	log := newTestLog(t)
+	log.Snapshots = SnapshotPolicy{EveryEntries: 3}
+	rec1 := uuid.New()
+
+	snapshots := 0
+	for i := 0; i < 7; i++ {
+		entry, err := log.Append(upsertDiff(rec1, fmt.Sprintf("%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry.Snapshot != nil {
+			snapshots++
+		}
+	}
+	//root and 2 entries, then every 3
+	assert.Equal(t, 2, snapshots)
+
+	//Snapshots hold the state including their own entry
+	records, err := log.Records()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "6", string(records[0].Raw))
+
+	//A reopened log continues counting from the chain
+	reopened := NewLog(log.credStore, log.store, log.Head())
+	reopened.Snapshots = log.Snapshots
+	entry, _ := reopened.Append(upsertDiff(rec1, `7`))
+	assert.NotNil(t, entry.Snapshot)
+	next, _ := reopened.Append(upsertDiff(rec1, `8`))
+	assert.Nil(t, next.Snapshot)
+
+	snapshot, err := RecoverSnapshot(entry.Snapshot.Target, log.store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapRecords := &Records{}
+	snapshot.GetRecords(log.credStore, snapRecords)
+	assert.Equal(t, "7", string(snapRecords.Records[0].Raw))
+}
+
+func TestSnapshotPolicyBytesAndInterval(t *testing.T) {
+	for _, policy := range []SnapshotPolicy{{EveryBytes: 1}, {Interval: time.Nanosecond}} {
+		log := newTestLog(t)
+		log.Snapshots = policy
+
+		entry, err := log.Append(upsertDiff(uuid.New(), `1`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.NotNil(t, entry.Snapshot)
+	}
+
+	log := newTestLog(t)
+	log.Snapshots = SnapshotPolicy{EveryBytes: 1 << 20, Interval: time.Hour}
+	entry, _ := log.Append(upsertDiff(uuid.New(), `1`))
+	assert.Nil(t, entry.Snapshot)
+}
+
+func TestCompactAndPrune(t *testing.T) {
+	log := newTestLog(t)
+	store := log.store.(*MemStore)
+	rec1 := uuid.New()
+
+	for i := 0; i < 5; i++ {
+		log.Append(upsertDiff(rec1, fmt.Sprintf("%d", i)))
+	}
+	forkRef := log.Head()
+
+	checkpoint, err := log.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, OpCheckpoint, checkpoint.Operation)
+	assert.NotNil(t, checkpoint.Snapshot)
+	log.Append(upsertDiff(rec1, `"after"`))
+
+	//A branch forked before the checkpoint
+	branch := NewLog(log.credStore, store, forkRef)
+	branchEntry, _ := branch.Append(upsertDiff(uuid.New(), `"branch"`))
+
+	prunable, err := log.Prunable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, prunable, 6)
+
+	//Drop the history locally
+	for _, ref := range prunable {
+		delete(store.Entries, ref)
+	}
+	store.Index = NewGraphIndex()
+
+	reader := NewLog(log.credStore, store, log.Head())
+	records, err := reader.Records()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, records, 1)
+	assert.Equal(t, `"after"`, string(records[0].Raw))
+
+	head, _ := NewEntryFromStorage(store, log.credStore, log.Head())
+	_, _, err = head.Merge(branchEntry)
+	assert.Equal(t, ErrHistoryPruned, err)
+}
+
+func TestMergePreSeriesLog(t *testing.T) {
+	/*
+		Test:
+			   root
+			    |
+			    a
+			   / \
+			  b1  b2
+
+		none of which record a clock or generation, merging b2 into b1 finds a as the base
+	*/
+
+	store := NewMemStore()
+	credStore := *generateTestCredStore()
+	id1, id2 := uuid.New(), uuid.New()
+
+	rootRef := appendLegacyEntry(t, nil, EntryDiff{Op: OpBase}, credStore, store)
+	aRef := appendLegacyEntry(t, &Link{rootRef}, upsertDiff(id1, `1`), credStore, store)
+	b1Ref := appendLegacyEntry(t, &Link{aRef}, upsertDiff(id1, `2`), credStore, store)
+	b2Ref := appendLegacyEntry(t, &Link{aRef}, upsertDiff(id2, `3`), credStore, store)
+
+	walker := newGraphWalker(store)
+	lca, _, err := walker.lowestCommonAncestor(b1Ref, b2Ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.NotNil(t, lca) {
+		assert.Equal(t, aRef, *lca)
+	}
+	node, _ := walker.node(b1Ref)
+	assert.Equal(t, uint64(2), node.Generation)
+
+	log := NewLog(credStore, store, b1Ref)
+	merge, err := log.Merge(b2Ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, uint64(3), merge.Generation)
+
+	records, err := log.Records()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, records, 2)
+	for _, rec := range records {
+		if rec.ID == id1 {
+			assert.Equal(t, `2`, string(rec.Raw))
+		}
+	}
+}
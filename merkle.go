@@ -0,0 +1,254 @@
+package otlog
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sort"
+
+	"github.com/google/uuid"
+
+	encrypt "github.com/tcfw/go-otlog/encrypt"
+)
+
+//RecordProof proves a record is part of a signed snapshot without revealing any other record. The
+//record is proven within its trie leaf by Path, then up the trie to the root by Levels
+type RecordProof struct {
+	Record Record           `json:"record"`
+	Salt   string           `json:"salt"`
+	Index  int              `json:"i"`
+	Count  int              `json:"n"`
+	Path   []string         `json:"path"`
+	Levels []TrieProofLevel `json:"levels,omitempty"`
+
+	//Snapshot the signed snapshot manifest, holding only links and keyed digests
+	Snapshot Snapshot `json:"snapshot"`
+}
+
+//TrieProofLevel the merkle hashes of the children of an interior trie node on the path to a record,
+//from the leaf up. Position is the child on the path, its hash is recomputed rather than taken
+type TrieProofLevel struct {
+	Position int      `json:"at"`
+	Indexes  []int    `json:"i"`
+	Merkles  []string `json:"m"`
+}
+
+//recordSalt a salt per record so leaves of other records cannot be guessed from the proof path
+func recordSalt(creds CredStore, id uuid.UUID) string {
+	return encrypt.Digest(append([]byte("salt:"), id[:]...), creds.getPass())
+}
+
+func merkleLeaf(rec Record, salt string) (string, error) {
+	raw, err := json.Marshal(rec)
+	if err != nil {
+		return "", err
+	}
+
+	hasher := sha256.New()
+	hasher.Write([]byte{0})
+	hasher.Write([]byte(salt))
+	hasher.Write(raw)
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+func merkleNode(left, right string) string {
+	l, _ := hex.DecodeString(left)
+	r, _ := hex.DecodeString(right)
+
+	hasher := sha256.New()
+	hasher.Write([]byte{1})
+	hasher.Write(l)
+	hasher.Write(r)
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+//merkleLeaves the leaves of the records sorted by ID
+func merkleLeaves(creds CredStore, records []Record) ([]Record, []string, error) {
+	sorted := make([]Record, len(records))
+	copy(sorted, records)
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i].ID[:], sorted[j].ID[:]) < 0
+	})
+
+	leaves := make([]string, len(sorted))
+	for i, rec := range sorted {
+		leaf, err := merkleLeaf(rec, recordSalt(creds, rec.ID))
+		if err != nil {
+			return nil, nil, err
+		}
+		leaves[i] = leaf
+	}
+	return sorted, leaves, nil
+}
+
+//merkleLevel hashes pairs of nodes, an odd node at the end is carried up unchanged
+func merkleLevel(level []string) []string {
+	next := make([]string, 0, (len(level)+1)/2)
+	for i := 0; i < len(level); i += 2 {
+		if i+1 == len(level) {
+			next = append(next, level[i])
+			continue
+		}
+		next = append(next, merkleNode(level[i], level[i+1]))
+	}
+	return next
+}
+
+//merkleRoot the root over the salted records, empty when there are none
+func merkleRoot(creds CredStore, records []Record) (string, error) {
+	_, level, err := merkleLeaves(creds, records)
+	if err != nil || len(level) == 0 {
+		return "", err
+	}
+
+	for len(level) > 1 {
+		level = merkleLevel(level)
+	}
+	return level[0], nil
+}
+
+//trieMerkle the merkle hash of an interior trie node over the hashes of its children
+func trieMerkle(children []TrieLink) string {
+	hasher := sha256.New()
+	hasher.Write([]byte{2})
+	for _, child := range children {
+		m, _ := hex.DecodeString(child.Merkle)
+		hasher.Write([]byte{byte(child.Index)})
+		hasher.Write(m)
+	}
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+//Prove produces an inclusion proof for a single record of the snapshot, fetching only the trie
+//nodes on the path to it
+func (s *Snapshot) Prove(creds CredStore, id uuid.UUID) (*RecordProof, error) {
+	if s.MerkleRoot == "" || s.Root == nil {
+		return nil, errors.New("Snapshot has no merkle root")
+	}
+	if s.store == nil {
+		return nil, errors.New("Snapshot has no storage, use RecoverSnapshot")
+	}
+	if err := s.validateManifest(); err != nil {
+		return nil, err
+	}
+
+	levels := []TrieProofLevel{}
+	link := *s.Root
+	var leaf []Record
+	for depth := 0; ; depth++ {
+		node, records, err := s.trieNode(creds, link)
+		if err != nil {
+			return nil, err
+		}
+		if link.Leaf {
+			leaf = records
+			break
+		}
+		if depth >= trieMaxDepth {
+			return nil, errors.New("Snapshot trie too deep")
+		}
+
+		level := TrieProofLevel{Position: -1}
+		index := trieIndex(id, depth)
+		for i, child := range node.Children {
+			level.Indexes = append(level.Indexes, child.Index)
+			level.Merkles = append(level.Merkles, child.Merkle)
+			if child.Index == index {
+				level.Position = i
+			}
+		}
+		if level.Position < 0 {
+			return nil, ErrRecordNotFound
+		}
+		levels = append([]TrieProofLevel{level}, levels...)
+		link = node.Children[level.Position]
+	}
+
+	sorted, level, err := merkleLeaves(creds, leaf)
+	if err != nil {
+		return nil, err
+	}
+
+	index := sort.Search(len(sorted), func(i int) bool {
+		return bytes.Compare(sorted[i].ID[:], id[:]) >= 0
+	})
+	if index == len(sorted) || sorted[index].ID != id {
+		return nil, ErrRecordNotFound
+	}
+
+	manifest := *s
+	manifest.store = nil
+	proof := &RecordProof{
+		Record:   sorted[index],
+		Salt:     recordSalt(creds, id),
+		Index:    index,
+		Count:    len(sorted),
+		Path:     []string{},
+		Levels:   levels,
+		Snapshot: manifest,
+	}
+
+	for i := index; len(level) > 1; i /= 2 {
+		if i%2 == 1 {
+			proof.Path = append(proof.Path, level[i-1])
+		} else if i+1 < len(level) {
+			proof.Path = append(proof.Path, level[i+1])
+		}
+		level = merkleLevel(level)
+	}
+
+	return proof, nil
+}
+
+//Verify checks the record is included in the snapshot and that the snapshot is signed by its
+//public cert, no password is needed
+func (p *RecordProof) Verify() error {
+	if p.Index < 0 || p.Index >= p.Count {
+		return errors.New("Proof index out of range")
+	}
+
+	hash, err := merkleLeaf(p.Record, p.Salt)
+	if err != nil {
+		return err
+	}
+
+	path := p.Path
+	for i, n := p.Index, p.Count; n > 1; i, n = i/2, (n+1)/2 {
+		if i%2 == 0 && i+1 == n {
+			//Carried up without a sibling
+			continue
+		}
+		if len(path) == 0 {
+			return errors.New("Proof path too short")
+		}
+		if i%2 == 1 {
+			hash = merkleNode(path[0], hash)
+		} else {
+			hash = merkleNode(hash, path[0])
+		}
+		path = path[1:]
+	}
+
+	if len(path) != 0 {
+		return errors.New("Proof path too long")
+	}
+
+	for _, level := range p.Levels {
+		if len(level.Indexes) != len(level.Merkles) || level.Position < 0 || level.Position >= len(level.Merkles) {
+			return errors.New("Invalid proof level")
+		}
+		children := make([]TrieLink, len(level.Indexes))
+		for i := range children {
+			children[i] = TrieLink{Index: level.Indexes[i], Merkle: level.Merkles[i]}
+		}
+		children[level.Position].Merkle = hash
+		hash = trieMerkle(children)
+	}
+	if hash != p.Snapshot.MerkleRoot {
+		return errors.New("Record is not part of the snapshot")
+	}
+
+	return p.Snapshot.validateManifest()
+}
@@ -0,0 +1,138 @@
+package otlog
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+//PinSet tracks the refs a store pinned, garbage collection only ever lists and unpins these so content
+//others pinned on a shared node is left alone
+type PinSet struct {
+	mu   sync.RWMutex
+	refs map[string]bool
+	path string
+	file *os.File
+}
+
+//NewPinSet creates an in memory pin set
+func NewPinSet() *PinSet {
+	return &PinSet{refs: map[string]bool{}}
+}
+
+//OpenPinSet loads a pin set persisted at path, one ref per line, new pins are appended to the file
+func OpenPinSet(path string) (*PinSet, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	p := NewPinSet()
+	reader := bufio.NewReader(file)
+	good := int64(0)
+	for {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			file.Close()
+			return nil, err
+		}
+		if ref := strings.TrimSpace(line); ref != "" {
+			p.refs[ref] = true
+		}
+		good += int64(len(line))
+	}
+
+	//Drop a partially written trailing ref, it is pinned again when next saved
+	if err := file.Truncate(good); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	p.path, p.file = path, file
+	return p, nil
+}
+
+//Close closes the persisted pin set file
+func (p *PinSet) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.file == nil {
+		return nil
+	}
+	err := p.file.Close()
+	p.file = nil
+	return err
+}
+
+//Has whether the ref was pinned
+func (p *PinSet) Has(ref string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.refs[ref]
+}
+
+//Refs every pinned ref
+func (p *PinSet) Refs() []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	refs := make([]string, 0, len(p.refs))
+	for ref := range p.refs {
+		refs = append(refs, ref)
+	}
+	sort.Strings(refs)
+	return refs
+}
+
+//Add records the ref as pinned
+func (p *PinSet) Add(ref string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.refs[ref] {
+		return nil
+	}
+	p.refs[ref] = true
+
+	if p.file != nil {
+		if _, err := p.file.WriteString(ref + "\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//Remove forgets the refs once unpinned, a persisted set is rewritten once without them
+func (p *PinSet) Remove(refs ...string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	removed := false
+	for _, ref := range refs {
+		if p.refs[ref] {
+			delete(p.refs, ref)
+			removed = true
+		}
+	}
+	if !removed || p.file == nil {
+		return nil
+	}
+
+	file, err := rewriteFile(p.file, p.path, func(w io.Writer) error {
+		for ref := range p.refs {
+			if _, err := io.WriteString(w, ref+"\n"); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	p.file = file
+	return err
+}
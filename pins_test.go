@@ -0,0 +1,59 @@
+package otlog
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPinSetPersist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "otlog-pins")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "pins")
+	pins, err := OpenPinSet(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pins.Add("a")
+	pins.Add("b")
+	pins.Add("c")
+	pins.Remove("b", "unpinned")
+	pins.Add("d")
+	pins.Close()
+
+	//Crash part way through writing a ref
+	file, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	file.WriteString("partial")
+	file.Close()
+
+	for i := 0; i < 2; i++ {
+		reloaded, err := OpenPinSet(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, []string{"a", "c", "d"}, reloaded.Refs())
+		assert.False(t, reloaded.Has("partial"))
+		reloaded.Close()
+	}
+}
+
+func TestIpfsStoreCollectsOnlyItsPins(t *testing.T) {
+	//Without a pin set every pin on the node would look collectable
+	_, err := CollectGarbage(&IpfsStore{}, []string{}, true)
+	assert.Error(t, err)
+
+	pins := NewPinSet()
+	pins.Add("a")
+	report, err := CollectGarbage(&IpfsStore{Pins: pins}, []string{}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"a"}, report.Removed)
+}
@@ -12,6 +12,9 @@ type Records struct {
 	log       *Entry
 	credStore CredStore
 
+	//previous the snapshot the records were recovered from, unchanged trie subtrees are reused from it
+	previous *Snapshot
+
 	Records []Record `json:"records"`
 }
 
@@ -22,7 +25,11 @@ func (r *Records) Snapshot(creds CredStore) (*Link, error) {
 
 //Record ~indivudualrecords
 type Record struct {
-	ID      uuid.UUID       `json:"_id"`
-	Raw     json.RawMessage `json:"d,omitempty"`
-	Deleted bool            `json:"del"`
+	ID      uuid.UUID         `json:"_id"`
+	Raw     json.RawMessage   `json:"d,omitempty"`
+	Deleted bool              `json:"del"`
+	Fields  map[string]*Field `json:"f,omitempty"`
+
+	//DeletedAt the clock of the latest delete of the record, field operations concurrent with it are dropped
+	DeletedAt *HLC `json:"delh,omitempty"`
 }
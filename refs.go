@@ -0,0 +1,64 @@
+package otlog
+
+import (
+	"errors"
+	"sync"
+)
+
+//ErrRefConflict the ref was moved by someone else since it was read
+var ErrRefConflict = errors.New("Ref has changed")
+
+//RefStore names heads, such as branches, so they can be shared and updated safely
+type RefStore interface {
+	//ListRefs every named ref
+	ListRefs() (map[string]string, error)
+
+	//GetRef the head of a named ref, empty if it does not exist
+	GetRef(name string) (string, error)
+
+	//CompareAndSwapRef moves the named ref to head only if it is still at old, an empty old creates it
+	CompareAndSwapRef(name, old, head string) error
+}
+
+//MemRefStore keeps refs in local memory
+type MemRefStore struct {
+	mu   sync.Mutex
+	refs map[string]string
+}
+
+//NewMemRefStore initiates a new mem ref store
+func NewMemRefStore() *MemRefStore {
+	return &MemRefStore{refs: map[string]string{}}
+}
+
+//ListRefs every named ref
+func (m *MemRefStore) ListRefs() (map[string]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	refs := make(map[string]string, len(m.refs))
+	for name, head := range m.refs {
+		refs[name] = head
+	}
+	return refs, nil
+}
+
+//GetRef the head of a named ref
+func (m *MemRefStore) GetRef(name string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.refs[name], nil
+}
+
+//CompareAndSwapRef moves the named ref to head only if it is still at old
+func (m *MemRefStore) CompareAndSwapRef(name, old, head string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.refs[name] != old {
+		return ErrRefConflict
+	}
+	m.refs[name] = head
+	return nil
+}
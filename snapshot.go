@@ -5,21 +5,70 @@ import (
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"time"
 
+	"github.com/google/uuid"
+
 	encrypt "github.com/tcfw/go-otlog/encrypt"
 )
 
+//DefaultShardSize the number of records per snapshot shard
+const DefaultShardSize = 512
+
 //Snapshot provides a struct to create snapshots or a record set
 type Snapshot struct {
+	store StorageEngine
+
 	PubCert   string    `json:"pk"`
 	Signature string    `json:"s"`
 	Time      time.Time `json:"t"`
-	Records   string    `json:"records"`
+	Records   string    `json:"records,omitempty"`
+	Root      *TrieLink `json:"root,omitempty"`
+
+	//MerkleRoot commits to every record so single records can be proven, see Prove
+	MerkleRoot string `json:"mr,omitempty"`
+}
+
+//SnapshotShard an encrypted leaf of records within a snapshot trie, or an interior node linking
+//the children of one
+type SnapshotShard struct {
+	Records  string     `json:"records,omitempty"`
+	Children []TrieLink `json:"c,omitempty"`
+}
+
+//snapshotManifest the signed part of a trie snapshot
+type snapshotManifest struct {
+	Time   time.Time `json:"t"`
+	Root   *TrieLink `json:"root,omitempty"`
+	Merkle string    `json:"mr,omitempty"`
 }
 
 //GetRecords returns the records stored within the snapshot
 func (s *Snapshot) GetRecords(creds CredStore, recordSet interface{}) error {
+	if s.Root != nil || s.Records == "" {
+		if err := s.validateManifest(); err != nil {
+			return err
+		}
+
+		records := []Record{}
+		if s.Root != nil {
+			if s.store == nil {
+				return errors.New("Snapshot has no storage, use RecoverSnapshot")
+			}
+			var err error
+			records, err = s.trieRecords(creds)
+			if err != nil {
+				return err
+			}
+		}
+
+		raw, err := json.Marshal(&Records{Records: records})
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(raw, recordSet)
+	}
 
 	// encrypt.ValidatePub(snapshot.PubKey, root)
 	rawBytes, err := base64.StdEncoding.DecodeString(s.Records)
@@ -65,9 +114,48 @@ func (s *Snapshot) ValidateSignature(data *[]byte) (bool, error) {
 	return true, nil
 }
 
-//NewSnapshot takes in records and saves to storage
+//GetRecord returns a single record, fetching only the parts of the snapshot which may hold it
+func (s *Snapshot) GetRecord(creds CredStore, id uuid.UUID) (*Record, error) {
+	switch {
+	case s.Root != nil:
+		if s.store == nil {
+			return nil, errors.New("Snapshot has no storage, use RecoverSnapshot")
+		}
+		if err := s.validateManifest(); err != nil {
+			return nil, err
+		}
+		return s.trieRecord(creds, id)
+	}
+
+	records := &Records{}
+	if err := s.GetRecords(creds, records); err != nil {
+		return nil, err
+	}
+	for _, rec := range records.Records {
+		if rec.ID == id {
+			return &rec, nil
+		}
+	}
+	return nil, ErrRecordNotFound
+}
+
+func (s *Snapshot) validateManifest() error {
+	manifest, err := json.Marshal(&snapshotManifest{Time: s.Time, Root: s.Root, Merkle: s.MerkleRoot})
+	if err != nil {
+		return err
+	}
+	_, err = s.ValidateSignature(&manifest)
+	return err
+}
+
+//NewSnapshot takes in records and saves to storage, record sets are stored as a trie
 func NewSnapshot(creds CredStore, records interface{}, storage StorageEngine) (*Link, error) {
-	//TODO Split records into shards
+	switch recs := records.(type) {
+	case *Records:
+		return NewTrieSnapshot(creds, recs.Records, storage, recs.previous, DefaultShardSize)
+	case []Record:
+		return NewTrieSnapshot(creds, recs, storage, nil, DefaultShardSize)
+	}
 
 	recordBytes, err := json.Marshal(records)
 	if err != nil {
@@ -106,9 +194,47 @@ func NewSnapshot(creds CredStore, records interface{}, storage StorageEngine) (*
 	return &Link{ref}, nil
 }
 
-//RecoverSnapshot gets the snapshot from storage
+//saveManifest signs and saves the snapshot for the manifest
+func saveManifest(creds CredStore, m *snapshotManifest, storage StorageEngine) (*Link, error) {
+	m.Time = time.Now().Round(0)
+
+	manifest, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+
+	pubCert, err := creds.getPubcert()
+	if err != nil {
+		return nil, err
+	}
+
+	sign, err := encrypt.Sign(manifest, *creds.getPrivKey())
+	if err != nil {
+		return nil, err
+	}
+
+	ref, err := storage.Save(&Snapshot{
+		PubCert:    pubCert,
+		Time:       m.Time,
+		Signature:  *sign,
+		Root:       m.Root,
+		MerkleRoot: m.Merkle,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Link{ref}, nil
+}
+
+//RecoverSnapshot gets the snapshot from storage, shards are fetched as they are read
 func RecoverSnapshot(ref string, storage StorageEngine) (*Snapshot, error) {
-	//TODO recover shards
+	snapshot, err := storage.GetSnapshot(ref)
+	if err != nil {
+		return nil, err
+	}
 
-	return storage.GetSnapshot(ref)
+	recovered := *snapshot
+	recovered.store = storage
+	return &recovered, nil
 }
@@ -1,6 +1,7 @@
 package otlog
 
 import (
+	"encoding/json"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -42,3 +43,147 @@ func TestRecoverSnapshot(t *testing.T) {
 	assert.NotEmpty(t, snapshot.Signature)
 	assert.NotEmpty(t, snapshot.Records)
 }
+
+//shardCountingStore counts shard fetches
+type shardCountingStore struct {
+	*MemStore
+	shardGets int
+}
+
+func (s *shardCountingStore) GetShard(ref string) (*SnapshotShard, error) {
+	s.shardGets++
+	return s.MemStore.GetShard(ref)
+}
+
+func TestTrieSnapshot(t *testing.T) {
+	credStore := *generateTestCredStore()
+	storage := &shardCountingStore{MemStore: NewMemStore()}
+
+	records := []Record{}
+	for i := 0; i < 200; i++ {
+		records = append(records, Record{ID: uuid.New(), Raw: []byte(`"Test"`)})
+	}
+
+	ref, err := NewTrieSnapshot(credStore, records, storage, nil, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot, _ := RecoverSnapshot(ref.Target, storage)
+	assert.NotNil(t, snapshot.Root)
+	assert.Equal(t, 200, snapshot.Root.Count)
+
+	recovered := &Records{}
+	if err := snapshot.GetRecords(credStore, recovered); err != nil {
+		t.Fatal(err)
+	}
+	assert.ElementsMatch(t, records, recovered.Records)
+
+	//Lookups only fetch the path to the record
+	for _, rec := range records[:20] {
+		storage.shardGets = 0
+		found, err := snapshot.GetRecord(credStore, rec.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, rec, *found)
+		assert.True(t, storage.shardGets <= 4, "fetched %d nodes", storage.shardGets)
+	}
+	_, err = snapshot.GetRecord(credStore, uuid.New())
+	assert.Equal(t, ErrRecordNotFound, err)
+
+	//Changing one record only rewrites its path
+	written := len(storage.Shards)
+	records[0].Raw = []byte(`"Changed"`)
+	ref, _ = NewTrieSnapshot(credStore, records, storage, snapshot, 4)
+	assert.True(t, len(storage.Shards)-written <= 4, "wrote %d nodes", len(storage.Shards)-written)
+
+	snapshot, _ = RecoverSnapshot(ref.Target, storage)
+	found, _ := snapshot.GetRecord(credStore, records[0].ID)
+	assert.Equal(t, `"Changed"`, string(found.Raw))
+
+	//Tampered manifest
+	snapshot.Root.Count++
+	assert.Error(t, snapshot.GetRecords(credStore, recovered))
+
+	//Empty record sets
+	ref, _ = NewSnapshot(credStore, &Records{Records: []Record{}}, storage)
+	snapshot, _ = RecoverSnapshot(ref.Target, storage)
+	recovered = &Records{}
+	assert.NoError(t, snapshot.GetRecords(credStore, recovered))
+	assert.Empty(t, recovered.Records)
+}
+
+func TestRecordProof(t *testing.T) {
+	credStore := *generateTestCredStore()
+	storage := NewMemStore()
+
+	records := []Record{}
+	for i := 0; i < 11; i++ {
+		records = append(records, Record{ID: uuid.New(), Raw: []byte(`"Test"`)})
+	}
+
+	ref, _ := NewSnapshot(credStore, records, storage)
+	snapshot, _ := RecoverSnapshot(ref.Target, storage)
+	assert.NotEmpty(t, snapshot.MerkleRoot)
+
+	for _, rec := range records {
+		proof, err := snapshot.Prove(credStore, rec.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		//Proofs are shared as JSON with partners
+		raw, _ := json.Marshal(proof)
+		shared := &RecordProof{}
+		json.Unmarshal(raw, shared)
+		assert.NoError(t, shared.Verify())
+		assert.Equal(t, rec, shared.Record)
+	}
+
+	proof, _ := snapshot.Prove(credStore, records[3].ID)
+	proof.Record.Raw = []byte(`"Forged"`)
+	assert.Error(t, proof.Verify())
+
+	proof, _ = snapshot.Prove(credStore, records[3].ID)
+	proof.Snapshot.MerkleRoot = proof.Path[0]
+	assert.Error(t, proof.Verify())
+
+	_, err := snapshot.Prove(credStore, uuid.New())
+	assert.Equal(t, ErrRecordNotFound, err)
+}
+
+func TestRecordProofDeepTrie(t *testing.T) {
+	credStore := *generateTestCredStore()
+	storage := NewMemStore()
+
+	records := []Record{}
+	for i := 0; i < 100; i++ {
+		records = append(records, Record{ID: uuid.New(), Raw: []byte(`"Test"`)})
+	}
+
+	ref, err := NewTrieSnapshot(credStore, records, storage, nil, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous, _ := RecoverSnapshot(ref.Target, storage)
+
+	//Unchanged subtrees keep their hashes, the root changes with the record
+	records[0].Raw = []byte(`"Changed"`)
+	ref, _ = NewTrieSnapshot(credStore, records, storage, previous, 4)
+	snapshot, _ := RecoverSnapshot(ref.Target, storage)
+	assert.NotEqual(t, previous.MerkleRoot, snapshot.MerkleRoot)
+
+	for _, rec := range records[:10] {
+		proof, err := snapshot.Prove(credStore, rec.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.NotEmpty(t, proof.Levels)
+		assert.NoError(t, proof.Verify())
+	}
+
+	proof, _ := snapshot.Prove(credStore, records[0].ID)
+	root := proof.Levels[len(proof.Levels)-1]
+	root.Merkles[(root.Position+1)%len(root.Merkles)] = proof.Salt
+	assert.Error(t, proof.Verify())
+}
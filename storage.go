@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"sync"
 )
 
 //StorageEngine helps save or get records from various sources
@@ -19,12 +20,22 @@ type StorageEngine interface {
 
 	//Get a snapshot, allows for separate snapshot storage location if required
 	GetSnapshot(ref string) (*Snapshot, error)
+
+	//Get a snapshot shard
+	GetShard(ref string) (*SnapshotShard, error)
 }
 
 //MemStore is a testing storage engine to use local memory
 type MemStore struct {
+	mu sync.RWMutex
+
 	Entries   map[string]*Entry
 	Snapshots map[string]*Snapshot
+	Shards    map[string]*SnapshotShard
+	Index     *GraphIndex
+
+	//Workers the number of entries fetched at once during walks, defaults to DefaultFetchWorkers
+	Workers int
 }
 
 //NewMemStore initiates a new mem storage engine
@@ -32,23 +43,43 @@ func NewMemStore() *MemStore {
 	return &MemStore{
 		Entries:   map[string]*Entry{},
 		Snapshots: map[string]*Snapshot{},
+		Shards:    map[string]*SnapshotShard{},
+		Index:     NewGraphIndex(),
 	}
 }
 
-//Get gets entry from direct record ref assuming the entry still has original properties
+//Graph the commit-graph index of stored entries
+func (m *MemStore) Graph() *GraphIndex {
+	return m.Index
+}
+
+//FetchWorkers the number of entries which may be fetched at once
+func (m *MemStore) FetchWorkers() int {
+	return m.Workers
+}
+
+//Get gets entry from direct record ref assuming the entry still has original properties,
+//a copy is given so callers can decrypt it without affecting the stored entry
 func (m *MemStore) Get(entry *Entry, ref string) (*Entry, error) {
+	m.mu.RLock()
 	rec, ok := m.Entries[ref]
+	m.mu.RUnlock()
 	if !ok {
 		return nil, errors.New("Unable to find reference")
 	}
 
-	rec.dataStore = m
+	cp := *rec
+	cp.dataStore = m
+	if entry.credStore.getPass() != "" {
+		//Entries received from elsewhere, e.g. over HTTP, hold no creds of their own
+		cp.credStore = entry.credStore
+	}
 
-	return rec, nil
+	return &cp, nil
 }
 
-//Save calculates a hash of the data then stores to local memory
-func (m *MemStore) Save(data interface{}) (string, error) {
+//HashRef the ref the data would be stored under
+func (m *MemStore) HashRef(data interface{}) (string, error) {
 	bytes, err := json.Marshal(data)
 	if err != nil {
 		return "", err
@@ -57,13 +88,27 @@ func (m *MemStore) Save(data interface{}) (string, error) {
 	hasher := sha256.New()
 	hasher.Write(bytes)
 	sum := hasher.Sum(nil)
-	sumStr := hex.EncodeToString(sum)
+	return hex.EncodeToString(sum), nil
+}
+
+//Save calculates a hash of the data then stores to local memory
+func (m *MemStore) Save(data interface{}) (string, error) {
+	sumStr, err := m.HashRef(data)
+	if err != nil {
+		return "", err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
 	switch ty := data.(type) {
 	case *Entry:
-		m.Entries[sumStr] = data.(*Entry)
+		cp := *ty
+		m.Entries[sumStr] = &cp
 	case *Snapshot:
 		m.Snapshots[sumStr] = data.(*Snapshot)
+	case *SnapshotShard:
+		m.Shards[sumStr] = ty
 	default:
 		return "", fmt.Errorf("Unknown type %s", ty)
 	}
@@ -72,10 +117,69 @@ func (m *MemStore) Save(data interface{}) (string, error) {
 
 //GetSnapshot gets snapshot from direct ref assuming the snapshot still has original properties
 func (m *MemStore) GetSnapshot(ref string) (*Snapshot, error) {
+	m.mu.RLock()
 	rec, ok := m.Snapshots[ref]
+	m.mu.RUnlock()
 	if !ok {
 		return nil, errors.New("Unable to find reference")
 	}
 
 	return rec, nil
 }
+
+//GetShard gets a snapshot shard from direct ref
+func (m *MemStore) GetShard(ref string) (*SnapshotShard, error) {
+	m.mu.RLock()
+	shard, ok := m.Shards[ref]
+	m.mu.RUnlock()
+	if !ok {
+		return nil, errors.New("Unable to find reference")
+	}
+
+	return shard, nil
+}
+
+//Refs every entry, snapshot and shard held
+func (m *MemStore) Refs() ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	refs := make([]string, 0, len(m.Entries)+len(m.Snapshots)+len(m.Shards))
+	for ref := range m.Entries {
+		refs = append(refs, ref)
+	}
+	for ref := range m.Snapshots {
+		refs = append(refs, ref)
+	}
+	for ref := range m.Shards {
+		refs = append(refs, ref)
+	}
+	return refs, nil
+}
+
+//Remove drops entries, snapshots or shards
+func (m *MemStore) Remove(refs ...string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, ref := range refs {
+		delete(m.Entries, ref)
+		delete(m.Snapshots, ref)
+		delete(m.Shards, ref)
+	}
+	if m.Index != nil {
+		return m.Index.Remove(refs...)
+	}
+	return nil
+}
+
+//Has whether an entry, snapshot or shard is held
+func (m *MemStore) Has(ref string) (bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	_, entry := m.Entries[ref]
+	_, snapshot := m.Snapshots[ref]
+	_, shard := m.Shards[ref]
+	return entry || snapshot || shard, nil
+}
@@ -0,0 +1,282 @@
+package otlog
+
+import (
+	"fmt"
+	"sort"
+)
+
+//Haver is a storage engine which can cheaply check whether it holds a ref
+type Haver interface {
+	Has(ref string) (bool, error)
+}
+
+//HasManyer is a storage engine which can check whether it holds many refs at once
+type HasManyer interface {
+	HasMany(refs []string) (map[string]bool, error)
+}
+
+//SyncProgress reports each object transferred by Sync
+type SyncProgress struct {
+	Ref         string
+	Transferred int
+	Total       int
+}
+
+//SyncReport the objects transferred by Sync
+type SyncReport struct {
+	Entries   int
+	Snapshots int
+	Shards    int
+}
+
+//syncWants the objects the destination lacks, in the order they are transferred
+type syncWants struct {
+	shards    []string
+	snapshots []string
+	entries   []string
+}
+
+//Sync copies the history of heads the destination lacks from src to dst. The walk stops at
+//entries dst already holds, as it holds their history too. Both stores must address objects the
+//same way, e.g. two IPFS nodes or two MemStores, as entries link to each other by ref. A MemStore
+//and an IpfsStore can not be synced with each other. Progress is called after each transfer if given
+func Sync(src, dst StorageEngine, heads []string, progress func(SyncProgress)) (*SyncReport, error) {
+	wants, err := negotiate(src, dst, heads)
+	if err != nil {
+		return nil, err
+	}
+
+	return wants.transfer(src, dst, progress)
+}
+
+//transfer copies the wanted objects from src to dst
+func (w *syncWants) transfer(src, dst StorageEngine, progress func(SyncProgress)) (*SyncReport, error) {
+	total := len(w.shards) + len(w.snapshots) + len(w.entries)
+	report := &SyncReport{}
+	done := func(ref string) {
+		if progress != nil {
+			progress(SyncProgress{Ref: ref, Transferred: report.Entries + report.Snapshots + report.Shards, Total: total})
+		}
+	}
+
+	//Dependencies first, so dst never holds an object without what it links to
+	for _, ref := range w.shards {
+		shard, err := src.GetShard(ref)
+		if err != nil {
+			return nil, err
+		}
+		if err := syncSave(dst, ref, shard); err != nil {
+			return nil, err
+		}
+		report.Shards++
+		done(ref)
+	}
+
+	for _, ref := range w.snapshots {
+		snapshot, err := src.GetSnapshot(ref)
+		if err != nil {
+			return nil, err
+		}
+		if err := syncSave(dst, ref, snapshot); err != nil {
+			return nil, err
+		}
+		report.Snapshots++
+		done(ref)
+	}
+
+	graph := storeGraph(dst)
+	for _, ref := range w.entries {
+		entry, err := src.Get(&Entry{dataStore: src, isEncrypted: true}, ref)
+		if err != nil {
+			return nil, err
+		}
+		if err := syncSave(dst, ref, entry); err != nil {
+			return nil, err
+		}
+		if graph != nil {
+			if _, err := graph.Add(ref, entry); err != nil {
+				return nil, err
+			}
+		}
+		report.Entries++
+		done(ref)
+	}
+
+	return report, nil
+}
+
+func syncSave(dst StorageEngine, ref string, data interface{}) error {
+	//Fail before anything is written where dst can tell
+	if hasher, ok := dst.(RefHasher); ok {
+		hashed, err := hasher.HashRef(data)
+		if err != nil {
+			return err
+		}
+		if hashed != ref {
+			return fmt.Errorf("Destination addresses %s as %s, stores must address objects the same way", ref, hashed)
+		}
+	}
+
+	saved, err := dst.Save(data)
+	if err != nil {
+		return err
+	}
+	if saved != ref {
+		return fmt.Errorf("Destination stored %s as %s, stores must address objects the same way", ref, saved)
+	}
+	return nil
+}
+
+//negotiate walks from the heads collecting what dst wants, entries are ordered parents first.
+//Each frontier of the walk is checked against dst at once. History pruned behind a checkpoint
+//is left out
+func negotiate(src, dst StorageEngine, heads []string) (*syncWants, error) {
+	wants := &syncWants{}
+	walker := newGraphWalker(src)
+	seen := map[string]bool{}
+	generations := map[string]uint64{}
+
+	frontier := append([]string{}, heads...)
+	for len(frontier) > 0 {
+		batch := []string{}
+		for _, ref := range frontier {
+			if !seen[ref] {
+				seen[ref] = true
+				batch = append(batch, ref)
+			}
+		}
+		frontier = nil
+
+		held, err := storeHasMany(dst, batch, objectEntry)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, ref := range batch {
+			if held[ref] {
+				continue
+			}
+
+			node, err := walker.node(ref)
+			if err == ErrHistoryPruned {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			wants.entries = append(wants.entries, ref)
+			generations[ref] = node.Generation
+
+			if node.Snapshot != "" && !seen[node.Snapshot] {
+				seen[node.Snapshot] = true
+				if err := wants.snapshot(src, dst, node.Snapshot, seen); err != nil {
+					return nil, err
+				}
+			}
+			frontier = append(frontier, node.Parents...)
+		}
+	}
+
+	sort.SliceStable(wants.entries, func(i, j int) bool {
+		return generations[wants.entries[i]] < generations[wants.entries[j]]
+	})
+	return wants, nil
+}
+
+//snapshot adds the snapshot and the trie nodes of it dst lacks
+func (w *syncWants) snapshot(src, dst StorageEngine, ref string, seen map[string]bool) error {
+	has, err := storeHas(dst, ref, objectSnapshot)
+	if err != nil || has {
+		return err
+	}
+
+	snapshot, err := RecoverSnapshot(ref, src)
+	if err != nil {
+		return err
+	}
+
+	links := []TrieLink{}
+	if snapshot.Root != nil {
+		links = append(links, *snapshot.Root)
+	}
+
+	shards := []string{}
+	for len(links) > 0 {
+		link := links[len(links)-1]
+		links = links[:len(links)-1]
+		if seen[link.Link.Target] {
+			continue
+		}
+		seen[link.Link.Target] = true
+
+		//Subtrees dst holds are shared with snapshots it already has
+		has, err := storeHas(dst, link.Link.Target, objectShard)
+		if err != nil {
+			return err
+		}
+		if has {
+			continue
+		}
+		shards = append(shards, link.Link.Target)
+
+		if !link.Leaf {
+			node, err := src.GetShard(link.Link.Target)
+			if err != nil {
+				return err
+			}
+			links = append(links, node.Children...)
+		}
+	}
+
+	//Children before the interior nodes linking them
+	for i := len(shards) - 1; i >= 0; i-- {
+		w.shards = append(w.shards, shards[i])
+	}
+	w.snapshots = append(w.snapshots, ref)
+	return nil
+}
+
+type objectKind int
+
+const (
+	objectEntry objectKind = iota
+	objectSnapshot
+	objectShard
+)
+
+//storeHas whether the store holds the ref, falling back to fetching it when the store cannot check.
+//Stores which may fetch from elsewhere, such as IPFS, should implement Haver
+func storeHas(store StorageEngine, ref string, kind objectKind) (bool, error) {
+	if haver, ok := store.(Haver); ok {
+		return haver.Has(ref)
+	}
+
+	var err error
+	switch kind {
+	case objectEntry:
+		_, err = store.Get(&Entry{dataStore: store, isEncrypted: true}, ref)
+	case objectSnapshot:
+		_, err = store.GetSnapshot(ref)
+	case objectShard:
+		_, err = store.GetShard(ref)
+	}
+	return err == nil, nil
+}
+
+//storeHasMany the subset of refs the store holds, in one check where the store supports it
+func storeHasMany(store StorageEngine, refs []string, kind objectKind) (map[string]bool, error) {
+	if haver, ok := store.(HasManyer); ok && len(refs) > 0 {
+		return haver.HasMany(refs)
+	}
+
+	held := map[string]bool{}
+	for _, ref := range refs {
+		has, err := storeHas(store, ref, kind)
+		if err != nil {
+			return nil, err
+		}
+		if has {
+			held[ref] = true
+		}
+	}
+	return held, nil
+}
@@ -0,0 +1,77 @@
+package otlog
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSync(t *testing.T) {
+	log := newTestLog(t)
+	log.Snapshots = SnapshotPolicy{EveryEntries: 2}
+	for i := 0; i < 5; i++ {
+		log.Append(upsertDiff(uuid.New(), `1`))
+	}
+
+	dst := NewMemStore()
+	progress := []SyncProgress{}
+	report, err := Sync(log.store, dst, []string{log.Head()}, func(p SyncProgress) {
+		progress = append(progress, p)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 6, report.Entries)
+	assert.Equal(t, 3, report.Snapshots)
+	assert.Len(t, progress, report.Entries+report.Snapshots+report.Shards)
+	assert.Equal(t, progress[len(progress)-1].Total, progress[len(progress)-1].Transferred)
+
+	replica := NewLog(log.credStore, dst, log.Head())
+	records, err := replica.Records()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, records, 5)
+	verify, _ := replica.Verify(log.Head(), nil)
+	assert.True(t, verify.OK(), "%v", verify.Problems)
+
+	//Only what was written since is transferred
+	log.Append(upsertDiff(uuid.New(), `2`))
+	log.Append(upsertDiff(uuid.New(), `3`))
+	report, err = Sync(log.store, dst, []string{log.Head()}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, &SyncReport{Entries: 2, Snapshots: 1, Shards: 1}, report)
+
+	report, _ = Sync(log.store, dst, []string{log.Head()}, nil)
+	assert.Equal(t, &SyncReport{}, report)
+}
+
+//prefixStore addresses objects differently to MemStore, as IPFS does
+type prefixStore struct {
+	*MemStore
+}
+
+func (p *prefixStore) HashRef(data interface{}) (string, error) {
+	ref, err := p.MemStore.HashRef(data)
+	return "x" + ref, err
+}
+
+func (p *prefixStore) Save(data interface{}) (string, error) {
+	ref, err := p.MemStore.Save(data)
+	return "x" + ref, err
+}
+
+func TestSyncDifferentAddressing(t *testing.T) {
+	log := newTestLog(t)
+	log.Append(upsertDiff(uuid.New(), `1`))
+
+	dst := &prefixStore{MemStore: NewMemStore()}
+	_, err := Sync(log.store, dst, []string{log.Head()}, nil)
+	assert.Error(t, err)
+
+	refs, _ := dst.Refs()
+	assert.Empty(t, refs)
+}
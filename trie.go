@@ -0,0 +1,252 @@
+package otlog
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/google/uuid"
+
+	encrypt "github.com/tcfw/go-otlog/encrypt"
+)
+
+//trieMaxDepth the number of nibbles in a record ID hash
+const trieMaxDepth = sha256.Size * 2
+
+//ErrRecordNotFound the record is not held in the snapshot
+var ErrRecordNotFound = errors.New("Record not found")
+
+//TrieLink links a node of a snapshot trie, digests are keyed so they can be compared without
+//revealing the records, a leaf's covers its records and an interior node's covers its children
+type TrieLink struct {
+	Index  int    `json:"i"`
+	Leaf   bool   `json:"lf,omitempty"`
+	Count  int    `json:"n"`
+	Digest string `json:"dg"`
+	Link   *Link  `json:"l"`
+
+	//Merkle the merkle hash of the subtree, reused with it so unchanged subtrees are not rehashed
+	Merkle string `json:"mk,omitempty"`
+}
+
+//trieIndex the child index of the record ID at the given depth of the trie
+func trieIndex(id uuid.UUID, depth int) int {
+	h := sha256.Sum256(id[:])
+	if depth%2 == 0 {
+		return int(h[depth/2] >> 4)
+	}
+	return int(h[depth/2] & 0x0f)
+}
+
+func trieDigest(children []TrieLink, pass string) string {
+	buf := bytes.Buffer{}
+	for _, child := range children {
+		buf.WriteString(strconv.Itoa(child.Index))
+		buf.WriteByte(':')
+		buf.WriteString(child.Digest)
+		buf.WriteByte(';')
+	}
+	return encrypt.Digest(buf.Bytes(), pass)
+}
+
+//NewTrieSnapshot saves the records as a hash-array-mapped trie keyed by record ID, with leaves
+//of up to bucketSize encrypted records. Subtrees unchanged from the previous snapshot are reused
+func NewTrieSnapshot(creds CredStore, records []Record, storage StorageEngine, previous *Snapshot, bucketSize int) (*Link, error) {
+	if bucketSize <= 0 {
+		return nil, errors.New("Bucket size must be positive")
+	}
+
+	var prev *TrieLink
+	if previous != nil {
+		prev = previous.Root
+	}
+
+	b := &trieBuilder{creds: creds, storage: storage, bucketSize: bucketSize}
+	root, err := b.build(records, 0, prev)
+	if err != nil {
+		return nil, err
+	}
+
+	return saveManifest(creds, &snapshotManifest{Root: &root, Merkle: root.Merkle}, storage)
+}
+
+type trieBuilder struct {
+	creds      CredStore
+	storage    StorageEngine
+	bucketSize int
+}
+
+func (b *trieBuilder) build(records []Record, depth int, prev *TrieLink) (TrieLink, error) {
+	if len(records) <= b.bucketSize || depth == trieMaxDepth {
+		return b.buildLeaf(records, prev)
+	}
+
+	groups := map[int][]Record{}
+	for _, rec := range records {
+		i := trieIndex(rec.ID, depth)
+		groups[i] = append(groups[i], rec)
+	}
+
+	prevChildren := map[int]*TrieLink{}
+	if prev != nil && !prev.Leaf {
+		node, err := b.storage.GetShard(prev.Link.Target)
+		if err != nil {
+			return TrieLink{}, err
+		}
+		for i := range node.Children {
+			prevChildren[node.Children[i].Index] = &node.Children[i]
+		}
+	}
+
+	children := []TrieLink{}
+	for i := 0; i < 16; i++ {
+		if len(groups[i]) == 0 {
+			continue
+		}
+		child, err := b.build(groups[i], depth+1, prevChildren[i])
+		if err != nil {
+			return TrieLink{}, err
+		}
+		child.Index = i
+		children = append(children, child)
+	}
+
+	digest := trieDigest(children, b.creds.getPass())
+	if prev != nil && !prev.Leaf && prev.Digest == digest {
+		return *prev, nil
+	}
+
+	ref, err := b.storage.Save(&SnapshotShard{Children: children})
+	if err != nil {
+		return TrieLink{}, err
+	}
+	return TrieLink{Count: len(records), Digest: digest, Link: &Link{ref}, Merkle: trieMerkle(children)}, nil
+}
+
+func (b *trieBuilder) buildLeaf(records []Record, prev *TrieLink) (TrieLink, error) {
+	sorted := make([]Record, len(records))
+	copy(sorted, records)
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i].ID[:], sorted[j].ID[:]) < 0
+	})
+
+	recordBytes, err := json.Marshal(sorted)
+	if err != nil {
+		return TrieLink{}, err
+	}
+
+	digest := encrypt.Digest(recordBytes, b.creds.getPass())
+	if prev != nil && prev.Leaf && prev.Digest == digest {
+		return *prev, nil
+	}
+
+	encBytes, err := encrypt.Seal(recordBytes, b.creds.getPass())
+	if err != nil {
+		return TrieLink{}, err
+	}
+
+	ref, err := b.storage.Save(&SnapshotShard{Records: base64.StdEncoding.EncodeToString(encBytes)})
+	if err != nil {
+		return TrieLink{}, err
+	}
+	merkle, err := merkleRoot(b.creds, sorted)
+	if err != nil {
+		return TrieLink{}, err
+	}
+	return TrieLink{Leaf: true, Count: len(records), Digest: digest, Link: &Link{ref}, Merkle: merkle}, nil
+}
+
+//trieNode fetches the node at link checking it against the digest of the link
+func (s *Snapshot) trieNode(creds CredStore, link TrieLink) (*SnapshotShard, []Record, error) {
+	node, err := s.store.GetShard(link.Link.Target)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !link.Leaf {
+		if trieDigest(node.Children, creds.getPass()) != link.Digest {
+			return nil, nil, errors.New("Snapshot node does not match its link")
+		}
+		return node, nil, nil
+	}
+
+	rawBytes, err := base64.StdEncoding.DecodeString(node.Records)
+	if err != nil {
+		return nil, nil, err
+	}
+	unencRaw, err := encrypt.Open(rawBytes, creds.getPass())
+	if err != nil {
+		return nil, nil, err
+	}
+	if encrypt.Digest(unencRaw, creds.getPass()) != link.Digest {
+		return nil, nil, errors.New("Snapshot node does not match its link")
+	}
+
+	records := []Record{}
+	if err := json.Unmarshal(unencRaw, &records); err != nil {
+		return nil, nil, err
+	}
+	return node, records, nil
+}
+
+//trieRecords fetches every record in the trie
+func (s *Snapshot) trieRecords(creds CredStore) ([]Record, error) {
+	records := []Record{}
+	stack := []TrieLink{*s.Root}
+	for len(stack) > 0 {
+		link := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		node, leaf, err := s.trieNode(creds, link)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, leaf...)
+		if !link.Leaf {
+			stack = append(stack, node.Children...)
+		}
+	}
+	return records, nil
+}
+
+//trieRecord fetches only the nodes on the path to the record
+func (s *Snapshot) trieRecord(creds CredStore, id uuid.UUID) (*Record, error) {
+	link := *s.Root
+	for depth := 0; ; depth++ {
+		node, leaf, err := s.trieNode(creds, link)
+		if err != nil {
+			return nil, err
+		}
+
+		if link.Leaf {
+			for _, rec := range leaf {
+				if rec.ID == id {
+					return &rec, nil
+				}
+			}
+			return nil, ErrRecordNotFound
+		}
+
+		if depth >= trieMaxDepth {
+			return nil, fmt.Errorf("Snapshot trie deeper than %d", trieMaxDepth)
+		}
+
+		next := -1
+		index := trieIndex(id, depth)
+		for i, child := range node.Children {
+			if child.Index == index {
+				next = i
+				break
+			}
+		}
+		if next < 0 {
+			return nil, ErrRecordNotFound
+		}
+		link = node.Children[next]
+	}
+}
@@ -0,0 +1,332 @@
+package otlog
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+//Check a kind of integrity check made by Verify
+type Check string
+
+const (
+	//CheckMissing the entry could not be fetched
+	CheckMissing Check = "missing"
+
+	//CheckHash the entry does not hash to its ref
+	CheckHash Check = "hash"
+
+	//CheckSignature the entry or snapshot failed decryption or signature validation
+	CheckSignature Check = "signature"
+
+	//CheckTrust the signing certificate is not trusted
+	CheckTrust Check = "trust"
+
+	//CheckTime the entry is not ordered after its parents, by HLC when both have one otherwise by time
+	CheckTime Check = "time"
+
+	//CheckOperation the operation or diff of the entry is not valid
+	CheckOperation Check = "operation"
+
+	//CheckGeneration the generation of the entry is not one more than the highest of its parents
+	CheckGeneration Check = "generation"
+
+	//CheckSnapshot the attached snapshot does not match replaying the history before it
+	CheckSnapshot Check = "snapshot"
+)
+
+//RefHasher is a storage engine which can calculate the ref of data without storing it
+type RefHasher interface {
+	HashRef(data interface{}) (string, error)
+}
+
+//Problem an integrity problem found with an entry
+type Problem struct {
+	Ref     string
+	Check   Check
+	Message string
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("%s: %s: %s", p.Ref, p.Check, p.Message)
+}
+
+//VerifyReport the outcome of verifying a log
+type VerifyReport struct {
+	Entries   int
+	Snapshots int
+	Pruned    int
+	Problems  []Problem
+}
+
+//OK whether no problems were found
+func (r *VerifyReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+func (r *VerifyReport) add(ref string, check Check, err error) {
+	r.Problems = append(r.Problems, Problem{Ref: ref, Check: check, Message: err.Error()})
+}
+
+//Verify walks the entire history of head checking every entry, continuing past problems so all
+//of them are reported. Certificates are only checked against trust when it is given
+func (l *Log) Verify(head string, trust *x509.CertPool) (*VerifyReport, error) {
+	report := &VerifyReport{Problems: []Problem{}}
+	walker := newGraphWalker(l.store)
+	view := l.view()
+
+	visited := map[string]bool{head: true}
+	stack := []string{head}
+	for len(stack) > 0 {
+		ref := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		node, err := walker.node(ref)
+		if err == ErrHistoryPruned {
+			report.Pruned++
+			continue
+		} else if err != nil {
+			report.add(ref, CheckMissing, err)
+			continue
+		}
+		report.Entries++
+
+		l.verifyEntry(walker, view, ref, node, trust, report)
+
+		for _, pRef := range node.Parents {
+			if !visited[pRef] {
+				visited[pRef] = true
+				stack = append(stack, pRef)
+			}
+		}
+	}
+
+	sort.SliceStable(report.Problems, func(i, j int) bool {
+		if report.Problems[i].Ref != report.Problems[j].Ref {
+			return report.Problems[i].Ref < report.Problems[j].Ref
+		}
+		return report.Problems[i].Check < report.Problems[j].Check
+	})
+	return report, nil
+}
+
+func (l *Log) verifyEntry(walker *graphWalker, view *Entry, ref string, node *GraphNode, trust *x509.CertPool, report *VerifyReport) {
+	stored, err := l.store.Get(&Entry{credStore: l.credStore, dataStore: l.store, isEncrypted: true}, ref)
+	if err != nil {
+		report.add(ref, CheckMissing, err)
+		return
+	}
+
+	if hasher, ok := l.store.(RefHasher); ok {
+		if hashed, err := hasher.HashRef(stored); err != nil || hashed != ref {
+			report.add(ref, CheckHash, fmt.Errorf("content hashes to %s", hashed))
+		}
+	}
+
+	if trust != nil {
+		if err := verifyTrust(stored.PublicCert, trust); err != nil {
+			report.add(ref, CheckTrust, err)
+		}
+	}
+
+	generation, parentsHeld := uint64(0), true
+	for _, pRef := range node.Parents {
+		parent, err := walker.node(pRef)
+		if err != nil {
+			parentsHeld = false
+			continue
+		}
+		if parent.Generation > generation {
+			generation = parent.Generation
+		}
+		//Wall clocks may skew between writers, HLCs are ordered after their parents regardless
+		if stored.Clock != nil && parent.Clock != nil {
+			if !parent.Clock.Before(*stored.Clock) {
+				report.add(ref, CheckTime, fmt.Errorf("clock %s not after parent %s", stored.Clock, pRef))
+			}
+		} else if stored.Time.Before(parent.Time) {
+			report.add(ref, CheckTime, fmt.Errorf("written before parent %s", pRef))
+		}
+	}
+
+	//Entries written before generations were recorded have none to check
+	if stored.Generation != 0 && parentsHeld && stored.Generation != generation+1 {
+		report.add(ref, CheckGeneration, fmt.Errorf("generation %d, parents give %d", stored.Generation, generation+1))
+	}
+
+	entry, err := NewEntryFromStorage(l.store, l.credStore, ref)
+	if err != nil {
+		report.add(ref, CheckSignature, err)
+		return
+	}
+
+	if err := verifyOperation(entry); err != nil {
+		report.add(ref, CheckOperation, err)
+		return
+	}
+
+	if entry.Snapshot != nil {
+		report.Snapshots++
+		if trust != nil {
+			if snapshot, err := l.store.GetSnapshot(entry.Snapshot.Target); err == nil {
+				if err := verifyTrust(snapshot.PubCert, trust); err != nil {
+					report.add(ref, CheckTrust, fmt.Errorf("snapshot %s: %s", entry.Snapshot.Target, err))
+				}
+			}
+		}
+		if err := verifySnapshot(walker, view, entry); err == ErrHistoryPruned {
+			report.Pruned++
+		} else if err != nil {
+			report.add(ref, CheckSnapshot, err)
+		}
+	}
+}
+
+func verifyTrust(cert string, trust *x509.CertPool) error {
+	decoded, err := base64.StdEncoding.DecodeString(cert)
+	if err != nil {
+		return err
+	}
+	pubCert, err := x509.ParseCertificate(decoded)
+	if err != nil {
+		return err
+	}
+
+	_, err = pubCert.Verify(x509.VerifyOptions{Roots: trust, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}})
+	return err
+}
+
+func verifyOperation(entry *Entry) error {
+	parents := 0
+	for _, parent := range entry.Parent {
+		if parent != nil {
+			parents++
+		}
+	}
+
+	switch entry.Operation {
+	case OpBase:
+		if parents != 0 {
+			return fmt.Errorf("base entry has %d parents", parents)
+		}
+		return nil
+	case OpMerge:
+		if parents < 2 {
+			return fmt.Errorf("merge entry has %d parents", parents)
+		}
+		if entry.Snapshot == nil {
+			return fmt.Errorf("merge entry has no snapshot")
+		}
+		return nil
+	case OpCheckpoint:
+		if entry.Snapshot == nil {
+			return fmt.Errorf("checkpoint entry has no snapshot")
+		}
+		return nil
+	case OpUpSert, OpDel, OpCRDT:
+	default:
+		return fmt.Errorf("Unknown operation %s", entry.Operation)
+	}
+
+	diff, err := entry.DataToStruct(&EntryDiff{})
+	if err != nil {
+		return err
+	}
+	if op := diff.(*EntryDiff).Op; op != entry.Operation {
+		return fmt.Errorf("diff operation %s does not match entry operation %s", op, entry.Operation)
+	}
+	return nil
+}
+
+//verifySnapshot checks the snapshot signature and that the history before the entry replays to it
+func verifySnapshot(walker *graphWalker, view *Entry, entry *Entry) error {
+	snapshot, err := RecoverSnapshot(entry.Snapshot.Target, view.dataStore)
+	if err != nil {
+		return err
+	}
+	attached := &Records{}
+	if err := snapshot.GetRecords(view.credStore, attached); err != nil {
+		return err
+	}
+
+	parentRefs := []string{}
+	for _, parent := range entry.Parent {
+		if parent == nil {
+			continue
+		}
+		if _, err := walker.node(parent.Target); err != nil {
+			return err
+		}
+		parentRefs = append(parentRefs, parent.Target)
+	}
+	parentEntries, err := fetchEntries(view.dataStore, view.credStore, parentRefs)
+	if err != nil {
+		return err
+	}
+	parents := make([]*Entry, 0, len(parentRefs))
+	for _, ref := range parentRefs {
+		parents = append(parents, parentEntries[ref])
+	}
+
+	var replayed []Record
+	switch {
+	case len(parents) > 1:
+		base, err := findMergeBase(parents)
+		if err != nil {
+			return err
+		}
+		records, err := view.recordsAt(base)
+		if err != nil {
+			return err
+		}
+		replayed, err = view.difference(base, parents, records)
+		if err != nil {
+			return err
+		}
+	case len(parents) == 1:
+		records, err := view.recordsAt(parentRefs[0])
+		if err != nil {
+			return err
+		}
+		replayed = records.Records
+	default:
+		replayed = []Record{}
+	}
+
+	if entry.Operation.hasDiff() {
+		diff, err := entry.DataToStruct(&EntryDiff{})
+		if err != nil {
+			return err
+		}
+		replayed, err = view.applyDiff(*diff.(*EntryDiff), entry.clock(), entry.parentRefs(), replayed)
+		if err != nil {
+			return err
+		}
+	}
+
+	want, err := canonicalRecords(replayed)
+	if err != nil {
+		return err
+	}
+	got, err := canonicalRecords(attached.Records)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(want, got) {
+		return fmt.Errorf("snapshot %s holds %d records, replaying gives %d", entry.Snapshot.Target, len(attached.Records), len(replayed))
+	}
+	return nil
+}
+
+//canonicalRecords the records encoded in ID order
+func canonicalRecords(records []Record) ([]byte, error) {
+	sorted := make([]Record, len(records))
+	copy(sorted, records)
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i].ID[:], sorted[j].ID[:]) < 0
+	})
+	return json.Marshal(sorted)
+}
@@ -0,0 +1,180 @@
+package otlog
+
+import (
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerify(t *testing.T) {
+	log := newTestLog(t)
+	log.Snapshots = SnapshotPolicy{EveryEntries: 2}
+	rootRef := log.Head()
+	rec1 := uuid.New()
+
+	log.Append(upsertDiff(rec1, `1`))
+	log.Append(EntryDiff{Op: OpCRDT, Record: Record{ID: rec1}, Fields: []FieldOp{NewCounterOp("n", 2)}})
+
+	branch := NewLog(log.credStore, log.store, rootRef)
+	branchHead, _ := branch.Append(upsertDiff(uuid.New(), `2`))
+	head, _ := NewEntryFromStorage(log.store, log.credStore, log.Head())
+	merge, _, err := head.Merge(branchHead)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mergeRef, _ := merge.Save("")
+	log = NewLog(log.credStore, log.store, mergeRef)
+	log.Compact()
+	log.Append(upsertDiff(rec1, `3`))
+
+	trust := x509.NewCertPool()
+	trust.AddCert(&log.credStore.pubCert)
+
+	report, err := log.Verify(log.Head(), trust)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, report.OK(), "%v", report.Problems)
+	assert.Equal(t, 7, report.Entries)
+	assert.Equal(t, 3, report.Snapshots)
+
+	//Untrusted certificates are reported for every entry and snapshot
+	report, _ = log.Verify(log.Head(), x509.NewCertPool())
+	assert.Len(t, report.Problems, 10)
+	assert.Equal(t, CheckTrust, report.Problems[0].Check)
+}
+
+func TestVerifyReportsAllProblems(t *testing.T) {
+	log := newTestLog(t)
+	store := log.store.(*MemStore)
+	rootRef := log.Head()
+	credStore := log.credStore
+
+	//Written before its parent
+	early, _ := NewEntry(&Link{rootRef}, credStore, store)
+	early.Time = early.Time.Add(-time.Hour)
+	early.Operation = OpUpSert
+	early.EncryptFromJSON(upsertDiff(uuid.New(), `1`))
+	early.Save("")
+
+	//Written without a HLC, as before clocks were added, so only the time can order it
+	early.Clock = nil
+	earlyRef, _ := store.HashRef(early)
+	store.Entries[earlyRef] = early
+
+	//Diff does not match the operation
+	_, mismatchRef := appendTestEntry(t, earlyRef, EntryDiff{Op: OpDel, Record: Record{ID: uuid.New()}}, credStore, store)
+	entry, _ := NewEntryFromStorage(store, credStore, mismatchRef)
+	entry.Operation = OpUpSert
+	entry.Clock = nil
+	entry.Generation = 0
+	entry.Encrypt(entry.Data)
+	mismatchRef, _ = entry.Save("")
+
+	//Snapshot which does not match the history
+	wrong, _ := NewEntry(&Link{mismatchRef}, credStore, store)
+	wrong.Operation = OpUpSert
+	wrong.Snapshot, _ = NewSnapshot(credStore, []Record{{ID: uuid.New()}}, store)
+	wrong.EncryptFromJSON(upsertDiff(uuid.New(), `2`))
+	wrongRef, _ := wrong.Save("")
+
+	//Tampered after it was stored
+	tampered, tamperedRef := appendTestEntry(t, wrongRef, upsertDiff(uuid.New(), `3`), credStore, store)
+	copied := *tampered
+	copied.Signature = early.Signature
+	store.Entries[tamperedRef] = &copied
+
+	report, err := log.Verify(tamperedRef, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checks := map[string][]Check{}
+	for _, problem := range report.Problems {
+		checks[problem.Ref] = append(checks[problem.Ref], problem.Check)
+	}
+	assert.Equal(t, []Check{CheckTime}, checks[earlyRef])
+	assert.Equal(t, []Check{CheckOperation}, checks[mismatchRef])
+	assert.Equal(t, []Check{CheckSnapshot}, checks[wrongRef])
+	assert.Equal(t, []Check{CheckHash, CheckSignature}, checks[tamperedRef])
+	assert.Len(t, report.Problems, 5)
+}
+
+func TestVerifyTimeUsesClock(t *testing.T) {
+	log := newTestLog(t)
+	store := log.store.(*MemStore)
+	rootRef := log.Head()
+	credStore := log.credStore
+	root, _ := NewEntryFromStorage(store, credStore, rootRef)
+
+	//Wall clock skewed behind the parent, the HLC is still ordered after it
+	skewed, _ := NewEntry(&Link{rootRef}, credStore, store)
+	skewed.Time = skewed.Time.Add(-time.Hour)
+	skewed.Operation = OpUpSert
+	skewed.EncryptFromJSON(upsertDiff(uuid.New(), `1`))
+	skewedRef, _ := skewed.Save("")
+
+	report, err := log.Verify(skewedRef, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, report.OK(), "%v", report.Problems)
+
+	//HLC not after the parent
+	stale, _ := NewEntry(&Link{rootRef}, credStore, store)
+	stale.Clock = root.Clock
+	stale.Operation = OpUpSert
+	stale.EncryptFromJSON(upsertDiff(uuid.New(), `2`))
+	staleRef, _ := stale.Save("")
+
+	report, err = log.Verify(staleRef, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, report.Problems, 1)
+	assert.Equal(t, CheckTime, report.Problems[0].Check)
+}
+
+func TestVerifySnapshotTrustAndGeneration(t *testing.T) {
+	log := newTestLog(t)
+	store := log.store.(*MemStore)
+	credStore := log.credStore
+	log.Append(upsertDiff(uuid.New(), `1`))
+	records, _ := log.Records()
+
+	//Snapshot signed by a certificate which is not trusted
+	other := generateTestCredStore()
+	checkpoint, _ := NewEntry(&Link{log.Head()}, credStore, store)
+	checkpoint.Operation = OpCheckpoint
+	checkpoint.Snapshot, _ = NewSnapshot(*other, records, store)
+	checkpoint.Encrypt("")
+	checkpointRef, _ := checkpoint.Save("")
+
+	//Generation which does not follow its parent
+	skipped, _ := NewEntry(&Link{checkpointRef}, credStore, store)
+	skipped.Operation = OpUpSert
+	clock := credStore.getClock().Update(*checkpoint.Clock)
+	skipped.Clock = &clock
+	skipped.Generation = checkpoint.Generation + 2
+	skipped.EncryptFromJSON(upsertDiff(uuid.New(), `2`))
+	skippedRef, _ := skipped.Save("")
+
+	trust := x509.NewCertPool()
+	trust.AddCert(&credStore.pubCert)
+
+	report, err := log.Verify(skippedRef, trust)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checks := map[string][]Check{}
+	for _, problem := range report.Problems {
+		checks[problem.Ref] = append(checks[problem.Ref], problem.Check)
+	}
+	assert.Equal(t, []Check{CheckTrust}, checks[checkpointRef])
+	assert.Equal(t, []Check{CheckGeneration}, checks[skippedRef])
+	assert.Len(t, report.Problems, 2)
+}